@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Sirupsen/logrus"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// reloadableSettings are the settings whose changes are applied without restarting the plugin
+var reloadableSettings = map[string]bool{
+	"configuration_name": true,
+	"tenant_id":          true,
+	"user":               true,
+	"password":           true,
+	"password-file":      true,
+	"log-level":          true,
+}
+
+// unconfigurableFlags are the flags which select what the plugin does instead of configuring it
+var unconfigurableFlags = map[string]bool{
+	"config":    true,
+	"check":     true,
+	"set-quota": true,
+	"version":   true,
+}
+
+// pluginConfig is the content of the config file. Settings are the values of the command
+// line flags keyed by the flag name, tenants holds default create options per tenant.
+type pluginConfig struct {
+	settings map[string]string
+	tenants  map[string]map[string]string
+}
+
+// parseConfig parses a TOML document whose keys are the names of the flags in flags, plus
+// a tenants table with the default create options per tenant
+func parseConfig(data []byte, flags *flag.FlagSet) (pluginConfig, error) {
+	var raw map[string]interface{}
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		return pluginConfig{}, err
+	}
+
+	config := pluginConfig{settings: make(map[string]string)}
+	for key, rawValue := range raw {
+		if key == "tenants" {
+			tenants, err := tenantDefaults(rawValue)
+			if err != nil {
+				return pluginConfig{}, fmt.Errorf("Invalid tenants: %s", err)
+			}
+			config.tenants = tenants
+			continue
+		}
+
+		f := flags.Lookup(key)
+		if f == nil || unconfigurableFlags[key] {
+			return pluginConfig{}, fmt.Errorf("Unknown setting %q", key)
+		}
+		value, err := settingValue(rawValue)
+		if err != nil {
+			return pluginConfig{}, fmt.Errorf("Invalid value of %s: %s", key, err)
+		}
+		if err := checkFlagValue(f, value); err != nil {
+			return pluginConfig{}, fmt.Errorf("Invalid value of %s: %s", key, err)
+		}
+		config.settings[key] = value
+	}
+
+	if level, ok := config.settings["log-level"]; ok {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return pluginConfig{}, err
+		}
+	}
+	for tenant, options := range config.tenants {
+		if _, ok := options["tenant_id"]; ok {
+			return pluginConfig{}, fmt.Errorf("Invalid defaults of tenant %s: tenant_id can not be a default", tenant)
+		}
+		if _, err := parseVolumeOptions(options, volumeOptions{}); err != nil {
+			return pluginConfig{}, fmt.Errorf("Invalid defaults of tenant %s: %s", tenant, err)
+		}
+	}
+	return config, nil
+}
+
+// tenantDefaults returns the options of the tables of the tenants table keyed by tenant
+func tenantDefaults(raw interface{}) (map[string]map[string]string, error) {
+	tables, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a table per tenant")
+	}
+
+	tenants := make(map[string]map[string]string)
+	for tenant, rawOptions := range tables {
+		options, ok := rawOptions.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a table of options for tenant %s", tenant)
+		}
+		tenants[tenant] = make(map[string]string)
+		for key, rawValue := range options {
+			value, err := settingValue(rawValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of option %s of tenant %s: %s", key, tenant, err)
+			}
+			tenants[tenant][key] = value
+		}
+	}
+	return tenants, nil
+}
+
+// settingValue returns the TOML string, number or boolean in the form the flags parse
+func settingValue(raw interface{}) (string, error) {
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("expected a string, number or boolean")
+}
+
+// checkFlagValue returns an error if value does not parse as a value of f, without changing f
+func checkFlagValue(f *flag.Flag, value string) error {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+
+	var err error
+	switch getter.Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(value)
+	case int:
+		_, err = strconv.Atoi(value)
+	case float64:
+		_, err = strconv.ParseFloat(value, 64)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	}
+	return err
+}
+
+// runtimeSettings are the settings of the driver which can change while the plugin runs
+type runtimeSettings struct {
+	tenantID   string
+	configName string
+	// tenantDefaults are the default create options per tenant
+	tenantDefaults map[string]map[string]string
+}
+
+// settingsStore shares the current runtimeSettings between all copies of the driver
+type settingsStore struct {
+	m        *sync.RWMutex
+	settings runtimeSettings
+}
+
+func newSettingsStore(settings runtimeSettings) *settingsStore {
+	return &settingsStore{m: &sync.RWMutex{}, settings: settings}
+}
+
+func (store *settingsStore) get() runtimeSettings {
+	store.m.RLock()
+	defer store.m.RUnlock()
+	return store.settings
+}
+
+func (store *settingsStore) set(settings runtimeSettings) {
+	store.m.Lock()
+	defer store.m.Unlock()
+	store.settings = settings
+}
+
+// configWatcher applies the config file to the flags at startup and reloads it on SIGHUP or
+// when its content changes. Reloaded changes of the reloadableSettings are applied to the
+// driver settings, the API credentials and the log level.
+type configWatcher struct {
+	path  string
+	flags *flag.FlagSet
+	// explicit are the flags given on the command line, they win over the config file
+	explicit map[string]bool
+	content  []byte
+	config   pluginConfig
+
+	settings    *settingsStore
+	credentials *apiCredentials
+}
+
+// loadConfigFile reads the config file at path and sets all flags which were not given on
+// the command line to its values
+func loadConfigFile(path string, flags *flag.FlagSet) (*configWatcher, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(content, flags)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", path, err)
+	}
+
+	watcher := &configWatcher{
+		path:     path,
+		flags:    flags,
+		explicit: make(map[string]bool),
+		content:  content,
+		config:   config,
+	}
+	flags.Visit(func(f *flag.Flag) {
+		watcher.explicit[f.Name] = true
+	})
+	for key, value := range config.settings {
+		if watcher.explicit[key] {
+			logrus.Infof("Setting %s of %s is overridden on the command line", key, path)
+			continue
+		}
+		if err := flags.Set(key, value); err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %s", path, err)
+		}
+	}
+	return watcher, nil
+}
+
+// value returns the effective value of a setting with config as config file. Command line
+// flags win over the config file, which wins over the environment and the defaults.
+func (watcher *configWatcher) value(config pluginConfig, key string) string {
+	f := watcher.flags.Lookup(key)
+	if watcher.explicit[key] {
+		return f.Value.String()
+	}
+	if value, ok := config.settings[key]; ok {
+		return value
+	}
+	return f.DefValue
+}
+
+// runtimeSettings returns the driver settings with config as config file
+func (watcher *configWatcher) runtimeSettings(config pluginConfig) runtimeSettings {
+	return runtimeSettings{
+		tenantID:       watcher.value(config, "tenant_id"),
+		configName:     watcher.value(config, "configuration_name"),
+		tenantDefaults: config.tenants,
+	}
+}
+
+// run reloads the config file on SIGHUP and whenever its content changed until stop is closed
+func (watcher *configWatcher) run(stop <-chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangup:
+			watcher.log().Infof("Reloading %s after SIGHUP", watcher.path)
+			watcher.reload(true)
+		case <-ticker.C:
+			watcher.reload(false)
+		}
+	}
+}
+
+func (watcher *configWatcher) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"op": "reload", "path": watcher.path})
+}
+
+// reload reads the config file and applies it if it changed or force is set. An invalid
+// config file is reported once and the current settings are kept.
+func (watcher *configWatcher) reload(force bool) {
+	content, err := ioutil.ReadFile(watcher.path)
+	if err != nil {
+		watcher.log().Errorf("Unable to read config file, keeping the current settings: %s", err)
+		return
+	}
+	if !force && bytes.Equal(content, watcher.content) {
+		return
+	}
+	watcher.content = content
+
+	config, err := parseConfig(content, watcher.flags)
+	if err != nil {
+		watcher.log().Errorf("Invalid config file, keeping the current settings: %s", err)
+		return
+	}
+	for _, key := range watcher.changedSettings(config) {
+		if reloadableSettings[key] {
+			watcher.log().Infof("Applying changed setting %s", key)
+		} else {
+			watcher.log().Warnf("Setting %s changed, restart the plugin to apply it", key)
+		}
+	}
+	if !reflect.DeepEqual(watcher.config.tenants, config.tenants) {
+		watcher.log().Infof("Applying changed tenant defaults")
+	}
+	watcher.apply(config)
+	watcher.config = config
+}
+
+// changedSettings returns the sorted names of the settings whose effective value differs
+// between the current config file and config
+func (watcher *configWatcher) changedSettings(config pluginConfig) []string {
+	keys := make(map[string]bool)
+	for key := range watcher.config.settings {
+		keys[key] = true
+	}
+	for key := range config.settings {
+		keys[key] = true
+	}
+
+	var changed []string
+	for key := range keys {
+		if watcher.value(watcher.config, key) != watcher.value(config, key) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// apply sets the reloadable settings of config
+func (watcher *configWatcher) apply(config pluginConfig) {
+	if level, err := logrus.ParseLevel(watcher.value(config, "log-level")); err == nil {
+		logrus.SetLevel(level)
+	}
+	if watcher.credentials != nil {
+		err := watcher.credentials.update(watcher.value(config, "user"), watcher.value(config, "password"),
+			watcher.value(config, "password-file"))
+		if err != nil {
+			watcher.log().Errorf("Keeping the current API credentials: %s", err)
+		}
+	}
+	if watcher.settings != nil {
+		watcher.settings.set(watcher.runtimeSettings(config))
+	}
+}
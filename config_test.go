@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("tenant_id", "env-tenant", "")
+	flags.String("configuration_name", "BASE", "")
+	flags.String("log-level", "info", "")
+	flags.String("api", "http://localhost:7860", "")
+	flags.Int("max-fs-checks", 5, "")
+	flags.Duration("mount-timeout", time.Minute, "")
+	flags.Bool("check", false, "")
+	return flags
+}
+
+func TestParseConfig(t *testing.T) {
+	expectedResults := map[string]error{
+		"tenant_id = \"a\"\nmax-fs-checks = 3\nmount-timeout = \"10s\"": nil,
+		"[tenants.a]\nconfiguration_name = \"ssd\"\nquota = \"1GiB\"":   nil,
+		"unknown = \"a\"":                      fmt.Errorf(`Unknown setting "unknown"`),
+		"check = true":                         fmt.Errorf(`Unknown setting "check"`),
+		"max-fs-checks = \"many\"":             fmt.Errorf(`Invalid value of max-fs-checks: strconv.Atoi: parsing "many": invalid syntax`),
+		"tenant_id = [\"a\"]":                  fmt.Errorf("Invalid value of tenant_id: expected a string, number or boolean"),
+		"log-level = \"loud\"":                 fmt.Errorf(`not a valid logrus Level: "loud"`),
+		"tenants = \"a\"":                      fmt.Errorf("Invalid tenants: expected a table per tenant"),
+		"[tenants]\na = \"ssd\"":               fmt.Errorf("Invalid tenants: expected a table of options for tenant a"),
+		"[tenants.a]\ntenant_id = \"b\"":       fmt.Errorf("Invalid defaults of tenant a: tenant_id can not be a default"),
+		"[tenants.a]\nquota = \"lots\"":        fmt.Errorf(`Invalid defaults of tenant a: Invalid value "lots" for option quota (alias for size): Invalid size "lots"`),
+		"tenant_id = \"a\"\ntenant_id = \"b\"": fmt.Errorf(`Near line 2 (last key parsed 'tenant_id'): Key 'tenant_id' has already been defined.`),
+	}
+
+	for config, res := range expectedResults {
+		_, got := parseConfig([]byte(config), newTestFlags())
+		if fmt.Sprint(got) != fmt.Sprint(res) {
+			log.Printf("Got:\n%v\nExpected:\n%v\nConfig:\n%s\n", got, res, config)
+			t.FailNow()
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quobyte-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.toml")
+
+	if err := ioutil.WriteFile(configPath, []byte("tenant_id = \"file-tenant\"\nconfiguration_name = \"file-config\"\nmax-fs-checks = 3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	flags := newTestFlags()
+	if err := flags.Parse([]string{"-configuration_name", "cli-config"}); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := loadConfigFile(configPath, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := flags.Lookup("max-fs-checks").Value.String(); got != "3" {
+		log.Printf("Got:\n%s\nExpected:\n%s\n", got, "3")
+		t.FailNow()
+	}
+	// Only the command line flags count as explicit, not the ones set from the config file
+	if !watcher.explicit["configuration_name"] || watcher.explicit["max-fs-checks"] || watcher.explicit["tenant_id"] {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", watcher.explicit, map[string]bool{"configuration_name": true})
+		t.FailNow()
+	}
+
+	store := newSettingsStore(watcher.runtimeSettings(watcher.config))
+	watcher.settings = store
+	expected := runtimeSettings{tenantID: "file-tenant", configName: "cli-config"}
+	if got := store.get(); got.tenantID != expected.tenantID || got.configName != expected.configName {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", got, expected)
+		t.FailNow()
+	}
+
+	// Invalid files keep the current settings, removed settings fall back to the environment
+	if err := ioutil.WriteFile(configPath, []byte("tenant_id = 1\nlog-level = \"loud\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	watcher.reload(false)
+	if got := store.get(); got.tenantID != expected.tenantID {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", got, expected)
+		t.FailNow()
+	}
+	if err := ioutil.WriteFile(configPath, []byte("[tenants.env-tenant]\nquota = \"1GiB\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	watcher.reload(false)
+	got := store.get()
+	if got.tenantID != "env-tenant" || got.configName != "cli-config" || got.tenantDefaults["env-tenant"]["quota"] != "1GiB" {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", got, "env-tenant, cli-config and the quota default")
+		t.FailNow()
+	}
+}
+
+func TestCreateOptions(t *testing.T) {
+	driver := quobyteDriver{
+		tenantID: "default",
+		tenantDefaults: map[string]map[string]string{
+			"default": {"configuration_name": "ssd", "quota": "1GiB"},
+			"other":   {"configuration_name": "hdd"},
+		},
+	}
+	expectedResults := []struct {
+		options  map[string]string
+		subdir   bool
+		expected map[string]string
+	}{
+		{map[string]string{}, false, map[string]string{"configuration_name": "ssd", "quota": "1GiB"}},
+		{map[string]string{"quota": "2GiB"}, false, map[string]string{"configuration_name": "ssd", "quota": "2GiB"}},
+		{map[string]string{"tenant_id": "other"}, false, map[string]string{"configuration_name": "hdd", "tenant_id": "other"}},
+		{map[string]string{"tenant_id": "unknown"}, false, map[string]string{"tenant_id": "unknown"}},
+		{map[string]string{}, true, map[string]string{"configuration_name": "ssd"}},
+	}
+
+	for _, res := range expectedResults {
+		got := driver.createOptions(res.options, res.subdir)
+		if fmt.Sprint(got) != fmt.Sprint(res.expected) {
+			log.Printf("Got:\n%v\nExpected:\n%v\n", got, res.expected)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/go-systemd/daemon"
+	quobyte_api "github.com/quobyte/api"
+)
+
+// healthChecker verifies the plugin can actually serve requests
+type healthChecker struct {
+	client *quobyte_api.QuobyteClient
+	// mountPath is the shared Quobyte mount, it is empty in per-volume mount mode
+	mountPath  string
+	socketPath string
+	timeout    time.Duration
+}
+
+// checkAPI verifies the API is reachable and accepts the credentials with a cheap RPC
+func (checker healthChecker) checkAPI() error {
+	ctx, cancel := context.WithTimeout(context.Background(), checker.timeout)
+	defer cancel()
+	_, err := checker.client.WithContext(ctx).GetTenants()
+	return err
+}
+
+// checkMount verifies the shared Quobyte mount is a live FUSE mount
+func (checker healthChecker) checkMount() error {
+	if checker.mountPath == "" {
+		return nil
+	}
+	if !isMounted(checker.mountPath) {
+		return fmt.Errorf("%s is not a quobyte mount", checker.mountPath)
+	}
+	return probeStat(checker.mountPath, checker.timeout)
+}
+
+// checkSocket verifies the plugin socket accepts connections
+func (checker healthChecker) checkSocket() error {
+	conn, err := net.DialTimeout("unix", checker.socketPath, checker.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// live runs the checks which only depend on this host
+func (checker healthChecker) live() map[string]error {
+	return map[string]error{
+		"mount":  checker.checkMount(),
+		"socket": checker.checkSocket(),
+	}
+}
+
+// ready runs all checks, a ready plugin can serve every request
+func (checker healthChecker) ready() map[string]error {
+	results := checker.live()
+	results["api"] = checker.checkAPI()
+	return results
+}
+
+// healthy reports whether all results passed and describes them, failed checks first
+func healthy(results map[string]error) (bool, []string) {
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ok := true
+	var failed, passed []string
+	for _, name := range names {
+		if err := results[name]; err != nil {
+			ok = false
+			failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+		} else {
+			passed = append(passed, fmt.Sprintf("%s: ok", name))
+		}
+	}
+	return ok, append(failed, passed...)
+}
+
+func writeHealth(w http.ResponseWriter, results map[string]error) {
+	ok, lines := healthy(results)
+	status := map[string]string{}
+	for name, err := range results {
+		status[name] = "ok"
+		if err != nil {
+			status[name] = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		logrus.WithField("op", "health").Warnf("Health check failed: %v", lines)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// ServeHTTP serves /healthz with the local checks and /readyz with all checks
+func (checker healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		writeHealth(w, checker.live())
+	case "/readyz":
+		writeHealth(w, checker.ready())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// notifySystemd tells systemd the plugin is ready once its socket accepts connections and
+// keeps petting the systemd watchdog while the socket does. An unhealthy Quobyte mount is
+// only reported by /healthz, restarting the plugin during a backend outage does not fix
+// it. Without NOTIFY_SOCKET it returns right away.
+func (checker healthChecker) notifySystemd() {
+	for checker.checkSocket() != nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sent, err := daemon.SdNotify(false, "READY=1")
+	if err != nil {
+		logrus.Warnf("Unable to notify systemd: %s", err)
+	}
+	if !sent {
+		return
+	}
+
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+	logrus.Infof("Notifying the systemd watchdog every %v", interval/2)
+	for range time.Tick(interval / 2) {
+		if err := checker.checkSocket(); err != nil {
+			logrus.WithField("op", "health").Warnf("Not notifying the systemd watchdog: socket: %s", err)
+			continue
+		}
+		daemon.SdNotify(false, "WATCHDOG=1")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealthy(t *testing.T) {
+	ok, lines := healthy(map[string]error{"socket": nil, "api": errors.New("connection refused"), "mount": nil})
+	expected := []string{"api: connection refused", "mount: ok", "socket: ok"}
+	if ok || !reflect.DeepEqual(lines, expected) {
+		log.Printf("Got:\n%v %q\nExpected:\nfalse %q\n", ok, lines, expected)
+		t.FailNow()
+	}
+}
+
+func TestHealthzChecksSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checker := healthChecker{socketPath: filepath.Join(dir, "quobyte.sock"), timeout: time.Second}
+	expectedResults := map[bool]int{false: http.StatusServiceUnavailable, true: http.StatusOK}
+	for _, listening := range []bool{false, true} {
+		if listening {
+			listener, err := net.Listen("unix", checker.socketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+		}
+
+		recorder := httptest.NewRecorder()
+		checker.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+		if recorder.Code != expectedResults[listening] {
+			log.Printf("Got:\n%d %s\nExpected:\n%d\n", recorder.Code, recorder.Body, expectedResults[listening])
+			t.FailNow()
+		}
+	}
+}
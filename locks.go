@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+)
+
+// volumeLocks serializes operations per volume name while operations on
+// different volumes run concurrently. Unused locks are dropped again.
+type volumeLocks struct {
+	m     *sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	m    sync.Mutex
+	refs int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		m:     &sync.Mutex{},
+		locks: make(map[string]*volumeLock),
+	}
+}
+
+// lock acquires the lock of the given volume and returns the function to release it
+func (locks *volumeLocks) lock(volumeName string) func() {
+	locks.m.Lock()
+	lock, ok := locks.locks[volumeName]
+	if !ok {
+		lock = &volumeLock{}
+		locks.locks[volumeName] = lock
+	}
+	lock.refs++
+	locks.m.Unlock()
+
+	lock.m.Lock()
+	return func() {
+		lock.m.Unlock()
+
+		locks.m.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(locks.locks, volumeName)
+		}
+		locks.m.Unlock()
+	}
+}
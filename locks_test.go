@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	locks := newVolumeLocks()
+
+	unlock := locks.lock("vol")
+	// A different volume must not be blocked
+	done := make(chan struct{})
+	go func() {
+		locks.lock("other")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		log.Println("Lock of other volume blocked by vol")
+		t.FailNow()
+	}
+
+	// The same volume has to wait for the lock to be released
+	var wg sync.WaitGroup
+	acquired := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		locks.lock("vol")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		log.Println("Lock of vol acquired twice")
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	wg.Wait()
+
+	if len(locks.locks) != 0 {
+		log.Printf("Got:\n%d\nExpected:\n%d\n", len(locks.locks), 0)
+		t.FailNow()
+	}
+}
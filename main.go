@@ -2,15 +2,24 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	quobyte_api "github.com/quobyte/api"
 )
 
 const (
 	quobyteID string = "quobyte"
+	// pluginSocket is where the plugin helpers create the socket Docker connects to
+	pluginSocket string = "/run/docker/plugins/" + quobyteID + ".sock"
 )
 
 var (
@@ -25,75 +34,360 @@ func getEnvWithDefault(key, fallback string) string {
 	return fallback
 }
 
+// getEnvInt and its typed siblings stop the plugin on values that do not parse instead of
+// silently using zero, e.g. after a typo in docker plugin set
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnvWithDefault(key, strconv.Itoa(fallback)))
+	if err != nil {
+		logrus.Fatalf("Invalid value for %s: %s", key, err)
+	}
+	return value
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(getEnvWithDefault(key, strconv.FormatFloat(fallback, 'g', -1, 64)), 64)
+	if err != nil {
+		logrus.Fatalf("Invalid value for %s: %s", key, err)
+	}
+	return value
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(getEnvWithDefault(key, strconv.FormatBool(fallback)))
+	if err != nil {
+		logrus.Fatalf("Invalid value for %s: %s", key, err)
+	}
+	return value
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnvWithDefault(key, fallback.String()))
+	if err != nil {
+		logrus.Fatalf("Invalid value for %s: %s", key, err)
+	}
+	return value
+}
+
+// setupLogging configures the level and format of the structured log and routes the
+// standard logger, which is used by the API client and other libraries, into it
+func setupLogging(level, format string) error {
+	parsedLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(parsedLevel)
+
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return fmt.Errorf("Unknown log format %q, valid formats are text and json", format)
+	}
+
+	log.SetFlags(0)
+	log.SetOutput(logrus.StandardLogger().Writer())
+	return nil
+}
+
+// serveHTTP serves mux on address until the listener fails
+func serveHTTP(address string, mux *http.ServeMux) {
+	logrus.Infof("Serving HTTP on %s", address)
+	logrus.Errorln(http.ListenAndServe(address, mux))
+}
+
 func main() {
 
-	maxFSChecksDefaultStr := getEnvWithDefault("MAX_FS_CHECKS", "5")
-	maxFSChecksDefault, _ := strconv.Atoi(maxFSChecksDefaultStr)
-	maxWaitTimeDefaultStr := getEnvWithDefault("MAX_WAIT_TIME", "64")
-	maxWaitTimeDefault, _ := strconv.ParseFloat(maxWaitTimeDefaultStr, 64)
+	maxFSChecksDefault := getEnvInt("MAX_FS_CHECKS", 5)
+	maxWaitTimeDefault := getEnvFloat("MAX_WAIT_TIME", 64)
 	quobyteAPIURLDefault := getEnvWithDefault("QUOBYTE_API_URL", "http://localhost:7860")
-	quobyteAPIPasswordDefault := getEnvWithDefault("QUOBYTE_API_PASSWORD", "quobyte")
+	// The password from the environment is no flag default, so -h does not print it
+	quobyteAPIPasswordEnv := getEnvWithDefault("QUOBYTE_API_PASSWORD", defaultAPIPassword)
+	quobyteAPIPasswordFileDefault := getEnvWithDefault("QUOBYTE_API_PASSWORD_FILE", "")
+	allowDefaultPasswordDefault := getEnvBool("QUOBYTE_API_ALLOW_DEFAULT_PASSWORD", false)
 	quobyteAPIUserDefault := getEnvWithDefault("QUOBYTE_API_USER", "admin")
 	quobyteMountPathDefault := getEnvWithDefault("QUOBYTE_MOUNT_PATH", "/run/docker/quobyte/mnt")
 	quobyteMountOptionsDefault := getEnvWithDefault("QUOBYTE_MOUNT_OPTIONS", "-o user_xattr")
+	quobyteMountHelperDefault := getEnvBool("QUOBYTE_MOUNT_HELPER", false)
+	quobyteMountTimeoutDefault := getEnvDuration("QUOBYTE_MOUNT_TIMEOUT", 60*time.Second)
+	quobyteMountModeDefault := getEnvWithDefault("QUOBYTE_MOUNT_MODE", mountModeShared)
+	watchdogIntervalDefault := getEnvDuration("QUOBYTE_WATCHDOG_INTERVAL", 30*time.Second)
 	quobyteRegistryDefault := getEnvWithDefault("QUOBYTE_REGISTRY", "localhost:7861")
 	quobyteTenantIDDefault := getEnvWithDefault("QUOBYTE_TENANT_ID", "NO-DEFAULT-CHANGE-ME")
 	quobyteVolConfigNameDefault := getEnvWithDefault("QUOBYTE_VOLUME_CONFIG_NAME", "BASE")
 	socketGroupDefault := getEnvWithDefault("SOCKET_GROUP", "root")
+	readOnlyPathDefault := getEnvWithDefault("QUOBYTE_READONLY_PATH", "/run/docker/quobyte/readonly")
+	logLevelDefault := getEnvWithDefault("QUOBYTE_LOG_LEVEL", "info")
+	logFormatDefault := getEnvWithDefault("QUOBYTE_LOG_FORMAT", "text")
+	healthAddressDefault := getEnvWithDefault("QUOBYTE_HEALTH_ADDRESS", "")
+	metricsAddressDefault := getEnvWithDefault("QUOBYTE_METRICS_ADDRESS", "")
+	stateFileDefault := getEnvWithDefault("QUOBYTE_STATE_FILE", "/run/docker/quobyte/state.json")
+	deletionPolicyDefault := getEnvWithDefault("QUOBYTE_DELETION_POLICY", deletionPolicyDelete)
+	quobyteAPICooldownDefault := getEnvDuration("QUOBYTE_API_COOLDOWN", 30*time.Second)
+	quobyteAPICAFileDefault := getEnvWithDefault("QUOBYTE_API_CA_FILE", "")
+	quobyteAPICertFileDefault := getEnvWithDefault("QUOBYTE_API_CERT_FILE", "")
+	quobyteAPIKeyFileDefault := getEnvWithDefault("QUOBYTE_API_KEY_FILE", "")
+	quobyteAPIServerNameDefault := getEnvWithDefault("QUOBYTE_API_SERVER_NAME", "")
+	quobyteAPIInsecureDefault := getEnvBool("QUOBYTE_API_INSECURE", false)
+	quobyteAPITimeoutDefault := getEnvDuration("QUOBYTE_API_TIMEOUT", 30*time.Second)
+	quobyteAPIRetriesDefault := getEnvInt("QUOBYTE_API_RETRIES", 3)
+	srvRefreshDefault := getEnvDuration("QUOBYTE_SRV_REFRESH", 60*time.Second)
+	configFileDefault := getEnvWithDefault("QUOBYTE_CONFIG_FILE", "")
 
 	maxFSChecks := flag.Int("max-fs-checks", maxFSChecksDefault,
 		"Maximimum number of filesystem checks when a Volume is created before returning an error")
 	maxWaitTime := flag.Float64("max-wait-time", maxWaitTimeDefault,
 		"Maximimum wait time for filesystem checks to complete when a Volume is created before returning an error")
 	quobyteAPIUser := flag.String("user", quobyteAPIUserDefault, "User to connect to the Quobyte API server")
-	quobyteAPIPassword := flag.String("password", quobyteAPIPasswordDefault,
-		"Password for the user to connect to the Quobyte API server")
+	quobyteAPIPassword := flag.String("password", "",
+		"Password for the user to connect to the Quobyte API server, defaults to QUOBYTE_API_PASSWORD. Command lines are visible to all users, prefer -password-file")
+	quobyteAPIPasswordFile := flag.String("password-file", quobyteAPIPasswordFileDefault,
+		"File with the password for the user to connect to the Quobyte API server, e.g. a Docker secret, reloaded on changes")
+	allowDefaultPassword := flag.Bool("allow-default-password", allowDefaultPasswordDefault,
+		"Allow the default password quobyte of fresh Quobyte installations, e.g. for test setups")
 	quobyteAPIURL := flag.String("api", quobyteAPIURLDefault,
 		"URL to the API server(s) in the form http(s)://host[:port][,host:port] or SRV record name")
+	quobyteAPICooldown := flag.Duration("api-cooldown", quobyteAPICooldownDefault,
+		"Time a failed API server is skipped before it is tried again")
+	quobyteAPICAFile := flag.String("api-ca-file", quobyteAPICAFileDefault,
+		"PEM file with the CA certificates trusted to sign the API server certificates")
+	quobyteAPICertFile := flag.String("api-cert-file", quobyteAPICertFileDefault,
+		"PEM file with the client certificate to authenticate at the API server")
+	quobyteAPIKeyFile := flag.String("api-key-file", quobyteAPIKeyFileDefault,
+		"PEM file with the key of the client certificate")
+	quobyteAPIServerName := flag.String("api-server-name", quobyteAPIServerNameDefault,
+		"Server name used to verify the API server certificates")
+	quobyteAPIInsecure := flag.Bool("api-insecure", quobyteAPIInsecureDefault,
+		"Do not verify the API server certificates (insecure)")
+	quobyteAPITimeout := flag.Duration("api-timeout", quobyteAPITimeoutDefault,
+		"Deadline of a single request to the API server")
+	quobyteAPIRetries := flag.Int("api-retries", quobyteAPIRetriesDefault,
+		"Number of retries of read-only API requests after connection failures or timeouts")
+	srvRefresh := flag.Duration("srv-refresh", srvRefreshDefault,
+		"Interval after which SRV records of the API servers are resolved again")
 	quobyteMountPath := flag.String("path", quobyteMountPathDefault, "Path where Quobyte is mounted on the host")
 	quobyteMountOptions := flag.String("options", quobyteMountOptionsDefault,
 		"Fuse options to be used when Quobyte is mounted")
+	quobyteMountHelper := flag.Bool("mount-helper", quobyteMountHelperDefault,
+		"Call the mount.quobyte helper directly instead of mount -t quobyte")
+	quobyteMountMode := flag.String("mount-mode", quobyteMountModeDefault,
+		"shared mounts all volumes at once under path, per-volume mounts each volume on its own while it is used")
+	quobyteMountTimeout := flag.Duration("mount-timeout", quobyteMountTimeoutDefault,
+		"Time after which a hanging mount command is killed")
+	watchdogInterval := flag.Duration("watchdog-interval", watchdogIntervalDefault,
+		"Interval in which the Quobyte mount is checked and remounted if it is stale, 0 disables the check")
+	readOnlyPath := flag.String("readonly-path", readOnlyPathDefault,
+		"Directory below which volumes created with readonly=true are bind mounted read-only")
 	quobyteRegistry := flag.String("registry", quobyteRegistryDefault,
 		"URL to the registry server(s) in the form of host[:port][,host:port] or SRV record name")
 	quobyteTenantID := flag.String("tenant_id", quobyteTenantIDDefault,
 		"Id of the Quobyte tenant in whose domain the operation takes place")
 	quobyteVolConfigName := flag.String("configuration_name", quobyteVolConfigNameDefault,
 		"Name of the volume configuration of new volumes")
-	socketGroup := flag.String("group", socketGroupDefault, "Group to create the unix socket")
+	socketGroup := flag.String("group", socketGroupDefault,
+		"Group to create the unix socket, empty keeps the group of the plugin process")
+	stateFile := flag.String("state", stateFileDefault, "File in which the active volume mounts are persisted")
+	deletionPolicy := flag.String("deletion-policy", deletionPolicyDefault,
+		"Default policy when a volume is removed: delete, retain, retain-if-not-created-by-plugin or trash")
+	logLevel := flag.String("log-level", logLevelDefault, "Log level: debug, info, warning or error")
+	logFormat := flag.String("log-format", logFormatDefault, "Log format: text (logfmt) or json")
+	metricsAddress := flag.String("metrics-address", metricsAddressDefault,
+		"Address like :9110 on which Prometheus metrics are served on /metrics, empty disables metrics")
+	healthAddress := flag.String("health-address", healthAddressDefault,
+		"Address like :9111 on which /healthz and /readyz are served, empty disables them")
+	configFile := flag.String("config", configFileDefault,
+		"TOML file with settings keyed by flag name and default create options per tenant, reloaded on SIGHUP and changes")
+	setQuotaVolume := flag.String("set-quota", "",
+		"Sets the quota of a volume to the options following the flags, like size=20GiB max_files=100000, and exits")
+	check := flag.Bool("check", false, "Checks the API, the Quobyte mount and the plugin socket and exits non-zero if one fails")
 	showVersion := flag.Bool("version", false, "Shows version string")
 
 	flag.Parse()
 
-	log.Printf("\nVariables read:\n"+
-		"MAX_FS_CHECKS: %v\nMAX_WAIT_TIME: %v\nSOCKET_GROUP: %s\n"+
-		"QUOBYTE_API_URL: %s\nQUOBYTE_API_USER: %s\nQUOBYTE_MOUNT_PATH:"+
-		" %s\nQUOBYTE_MOUNT_OPTIONS: %s\nQUOBYTE_REGISTRY: %s\nQUOBYTE_TENANT_ID: "+
+	var watcher *configWatcher
+	if *configFile != "" {
+		var err error
+		if watcher, err = loadConfigFile(*configFile, flag.CommandLine); err != nil {
+			logrus.Fatalln(err)
+		}
+	}
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		logrus.Fatalln(err)
+	}
+
+	// The config file sets the flags as well, only the ones given on the command line are visible to all users
+	explicit := make(map[string]bool)
+	if watcher != nil {
+		explicit = watcher.explicit
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+	}
+	if explicit["password"] {
+		logrus.Warnln("The API password was given on the command line, which is visible to all users, use -password-file instead")
+	}
+
+	logrus.Infof("\nVariables read:\n"+
+		"MAX_FS_CHECKS: %v\nMAX_WAIT_TIME: %v\nSOCKET_GROUP: %s\nQUOBYTE_STATE_FILE: %s\nQUOBYTE_DELETION_POLICY: %s\nQUOBYTE_METRICS_ADDRESS: %s\nQUOBYTE_HEALTH_ADDRESS: %s\nQUOBYTE_LOG_LEVEL: %s\nQUOBYTE_LOG_FORMAT: %s\nQUOBYTE_CONFIG_FILE: %s\n"+
+		"QUOBYTE_API_URL: %s\nQUOBYTE_API_COOLDOWN: %v\nQUOBYTE_API_TIMEOUT: %v\nQUOBYTE_API_RETRIES: %v\nQUOBYTE_SRV_REFRESH: %v\nQUOBYTE_API_CA_FILE: %s\nQUOBYTE_API_CERT_FILE: %s\nQUOBYTE_API_KEY_FILE: %s\n"+
+		"QUOBYTE_API_SERVER_NAME: %s\nQUOBYTE_API_INSECURE: %v\nQUOBYTE_API_USER: %s\nQUOBYTE_API_PASSWORD_FILE: %s\nQUOBYTE_API_ALLOW_DEFAULT_PASSWORD: %v\nQUOBYTE_MOUNT_PATH:"+
+		" %s\nQUOBYTE_MOUNT_OPTIONS: %s\nQUOBYTE_MOUNT_HELPER: %v\nQUOBYTE_MOUNT_MODE: %s\nQUOBYTE_MOUNT_TIMEOUT: %v\nQUOBYTE_WATCHDOG_INTERVAL: %v\nQUOBYTE_READONLY_PATH: %s\nQUOBYTE_REGISTRY: %s\nQUOBYTE_TENANT_ID: "+
 		" %s\nQUOBYTE_VOLUME_CONFIG_NAME: %s\n", *maxFSChecks, *maxWaitTime,
-		*socketGroup, *quobyteAPIURL, *quobyteAPIUser,
-		*quobyteMountPath, *quobyteMountOptions, *quobyteRegistry, *quobyteTenantID,
+		*socketGroup, *stateFile, *deletionPolicy, *metricsAddress, *healthAddress, *logLevel, *logFormat, *configFile, *quobyteAPIURL, *quobyteAPICooldown, *quobyteAPITimeout, *quobyteAPIRetries, *srvRefresh,
+		*quobyteAPICAFile, *quobyteAPICertFile, *quobyteAPIKeyFile, *quobyteAPIServerName, *quobyteAPIInsecure, *quobyteAPIUser, *quobyteAPIPasswordFile, *allowDefaultPassword,
+		*quobyteMountPath, *quobyteMountOptions, *quobyteMountHelper, *quobyteMountMode, *quobyteMountTimeout, *watchdogInterval, *readOnlyPath, *quobyteRegistry, *quobyteTenantID,
 		*quobyteVolConfigName)
 
 	if *showVersion {
-		log.Printf("\nVersion: %s - Revision: %s\n", version, revision)
+		logrus.Infof("\nVersion: %s - Revision: %s", version, revision)
 		return
 	}
 
 	if err := validateAPIURL(*quobyteAPIURL); err != nil {
-		log.Fatalln(err)
+		logrus.Fatalln(err)
+	}
+
+	if err := validateDeletionPolicy(*deletionPolicy); err != nil {
+		logrus.Fatalln(err)
+	}
+
+	if err := validateMountMode(*quobyteMountMode); err != nil {
+		logrus.Fatalln(err)
+	}
+
+	credentials, err := newAPICredentials(*quobyteAPIUser, *quobyteAPIPassword, *quobyteAPIPasswordFile,
+		quobyteAPIPasswordEnv, *allowDefaultPassword)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	state, err := loadPluginState(*stateFile)
+	if err != nil {
+		logrus.Errorf("Unable to load mount state from %s, starting with empty state: %s", *stateFile, err)
+	}
+
+	apiUser, apiPassword := credentials.get()
+	if apiPassword == "" {
+		logrus.Warnln("No API password is set, use QUOBYTE_API_PASSWORD_FILE unless the API accepts the client certificate")
+	}
+	qDriver := newQuobyteDriver(*quobyteAPIURL, apiUser, apiPassword,
+		*quobyteMountPath, *maxFSChecks, *maxWaitTime, *quobyteVolConfigName, *quobyteTenantID, *deletionPolicy, state)
+	qDriver.readOnlyMount = *readOnlyPath
+	credentials.client = qDriver.client
+	if watcher != nil {
+		qDriver.settings = newSettingsStore(watcher.runtimeSettings(watcher.config))
+		watcher.settings = qDriver.settings
+		watcher.credentials = credentials
+	}
+	qDriver.client.SetEndpointCooldown(*quobyteAPICooldown)
+	qDriver.client.SetSRVRefresh(*srvRefresh)
+	qDriver.client.SetTimeout(*quobyteAPITimeout)
+	qDriver.client.SetRetries(*quobyteAPIRetries)
+	tlsOptions := quobyte_api.TLSOptions{
+		CAFile:     *quobyteAPICAFile,
+		CertFile:   *quobyteAPICertFile,
+		KeyFile:    *quobyteAPIKeyFile,
+		ServerName: *quobyteAPIServerName,
+		Insecure:   *quobyteAPIInsecure,
+	}
+	if tlsOptions != (quobyte_api.TLSOptions{}) {
+		if tlsOptions.Insecure {
+			logrus.Warnln("Verification of the API server certificates is disabled, do not use this in production")
+		}
+		if err := qDriver.client.SetTLSOptions(tlsOptions); err != nil {
+			logrus.Fatalf("Unable to configure TLS for the API client: %s", err)
+		}
+	}
+
+	checker := healthChecker{
+		client:     qDriver.client.WithLogger(logrus.WithField("op", "health")),
+		socketPath: pluginSocket,
+		timeout:    10 * time.Second,
+	}
+	if *quobyteMountMode != mountModePerVolume {
+		checker.mountPath = *quobyteMountPath
+	}
+	if *setQuotaVolume != "" {
+		if err := setQuota(qDriver.client.WithLogger(logrus.WithField("op", "set-quota")), *quobyteTenantID, *setQuotaVolume, flag.Args()); err != nil {
+			logrus.Fatalf("Unable to set quota of volume %s: %s", *setQuotaVolume, err)
+		}
+		fmt.Printf("Quota of volume %s set\n", *setQuotaVolume)
+		return
+	}
+	if *check {
+		ok, lines := healthy(checker.ready())
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
 	}
 
 	if err := os.MkdirAll(*quobyteMountPath, 0555); err != nil {
-		log.Println(err.Error())
+		logrus.Warnln(err.Error())
 	}
 
-	if !isMounted(*quobyteMountPath) {
-		log.Printf("Mounting Quobyte namespace in %s", *quobyteMountPath)
-		mountAll(*quobyteMountOptions, *quobyteRegistry, *quobyteMountPath)
+	mountOptions := mountConfig{
+		options:   *quobyteMountOptions,
+		registry:  *quobyteRegistry,
+		useHelper: *quobyteMountHelper,
+		timeout:   *quobyteMountTimeout,
+	}
+	if *quobyteMountMode == mountModePerVolume {
+		logrus.Infof("Mounting Quobyte volumes on their own below %s", *quobyteMountPath)
+		qDriver.mounter = &volumeMounter{base: *quobyteMountPath, config: mountOptions}
+	} else if !isMounted(*quobyteMountPath) {
+		logrus.Infof("Mounting Quobyte namespace in %s", *quobyteMountPath)
+		if err := mountAll(mountOptions, *quobyteMountPath); err != nil {
+			logrus.Fatalln(err)
+		}
+	} else {
+		logrus.Infof("Found Mountpoint: %s", *quobyteMountPath)
+	}
+	if *quobyteMountMode != mountModePerVolume && *watchdogInterval > 0 {
+		qDriver.watchdog = newMountWatchdog(*quobyteMountPath, mountOptions, *watchdogInterval)
+		go qDriver.watchdog.run(make(chan struct{}))
 	}
 
-	qDriver := newQuobyteDriver(*quobyteAPIURL, *quobyteAPIUser, *quobyteAPIPassword,
-		*quobyteMountPath, *maxFSChecks, *maxWaitTime, *quobyteVolConfigName, *quobyteTenantID)
-	handler := volume.NewHandler(qDriver)
+	go credentials.run(make(chan struct{}))
+	if watcher != nil {
+		go watcher.run(make(chan struct{}))
+	} else {
+		// Without config file there is nothing to reload, systemctl reload must not stop the plugin
+		signal.Ignore(syscall.SIGHUP)
+	}
+
+	// Metrics and health checks may share one listener
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	var driver volume.Driver = qDriver
+	if *metricsAddress != "" {
+		metrics := newPluginMetrics()
+		qDriver.metrics = metrics
+		qDriver.client.SetRequestObserver(metrics.observeAPI)
+		metrics.watchDriver(qDriver)
+		driver = instrumentedDriver{driver: qDriver, metrics: metrics}
+		muxFor(*metricsAddress).Handle("/metrics", metrics)
+	}
+	if *healthAddress != "" {
+		muxFor(*healthAddress).Handle("/healthz", checker)
+		muxFor(*healthAddress).Handle("/readyz", checker)
+	}
+	for address, mux := range muxes {
+		go serveHTTP(address, mux)
+	}
+	go checker.notifySystemd()
 
-	log.Println(handler.ServeUnix(*socketGroup, quobyteID))
+	handler := volume.NewHandler(driver)
+	logrus.Errorln(handler.ServeUnix(*socketGroup, quobyteID))
 }
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// counterVec is a Prometheus counter partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	m      *sync.Mutex
+	series map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, m: &sync.Mutex{}, series: make(map[string]float64)}
+}
+
+func (vec *counterVec) inc(labelValues ...string) {
+	vec.m.Lock()
+	defer vec.m.Unlock()
+	vec.series[formatLabels(vec.labels, labelValues)]++
+}
+
+func (vec *counterVec) write(w io.Writer) {
+	vec.m.Lock()
+	defer vec.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", vec.name, vec.help, vec.name)
+	var keys []string
+	for labels := range vec.series {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%s %s\n", seriesName(vec.name, labels), formatValue(vec.series[labels]))
+	}
+}
+
+// histogram holds the cumulative bucket counts of one histogram series
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// histogramVec is a Prometheus histogram partitioned by labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	m       *sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: latencyBuckets,
+		m: &sync.Mutex{}, series: make(map[string]*histogram)}
+}
+
+func (vec *histogramVec) observe(seconds float64, labelValues ...string) {
+	vec.m.Lock()
+	defer vec.m.Unlock()
+
+	key := formatLabels(vec.labels, labelValues)
+	series, ok := vec.series[key]
+	if !ok {
+		series = &histogram{buckets: make([]uint64, len(vec.buckets))}
+		vec.series[key] = series
+	}
+	for i, bound := range vec.buckets {
+		if seconds <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+func (vec *histogramVec) write(w io.Writer) {
+	vec.m.Lock()
+	defer vec.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", vec.name, vec.help, vec.name)
+	var keys []string
+	for labels := range vec.series {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		series := vec.series[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range vec.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", vec.name, prefix, formatValue(bound), series.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", vec.name, prefix, series.count)
+		fmt.Fprintf(w, "%s %s\n", seriesName(vec.name+"_sum", labels), formatValue(series.sum))
+		fmt.Fprintf(w, "%s %d\n", seriesName(vec.name+"_count", labels), series.count)
+	}
+}
+
+// gaugeSample is a single value of a gauge which is collected when the metrics are scraped
+type gaugeSample struct {
+	labels string
+	value  float64
+}
+
+// gauge is a Prometheus gauge whose samples are collected on every scrape
+type gauge struct {
+	name    string
+	help    string
+	collect func() []gaugeSample
+}
+
+func (g gauge) write(w io.Writer) {
+	samples := g.collect()
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s %s\n", seriesName(g.name, sample.labels), formatValue(sample.value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func seriesName(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func resultOf(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// pluginMetrics collects the metrics of the driver and the API client
+type pluginMetrics struct {
+	driverRequests *counterVec
+	driverLatency  *histogramVec
+	apiRequests    *counterVec
+	apiLatency     *histogramVec
+	createWait     *histogramVec
+	gauges         []gauge
+}
+
+func newPluginMetrics() *pluginMetrics {
+	return &pluginMetrics{
+		driverRequests: newCounterVec("quobyte_plugin_driver_requests_total",
+			"Number of VolumeDriver requests handled by the plugin.", "method", "result"),
+		driverLatency: newHistogramVec("quobyte_plugin_driver_request_duration_seconds",
+			"Latency of VolumeDriver requests.", "method"),
+		apiRequests: newCounterVec("quobyte_plugin_api_requests_total",
+			"Number of Quobyte API requests including their retries.", "method", "result"),
+		apiLatency: newHistogramVec("quobyte_plugin_api_request_duration_seconds",
+			"Latency of Quobyte API requests including their retries.", "method"),
+		createWait: newHistogramVec("quobyte_plugin_create_mount_wait_seconds",
+			"Time a created volume took to become visible in the Quobyte mount."),
+	}
+}
+
+// observeDriver records a VolumeDriver request. Responses carrying an error count as failed.
+func (metrics *pluginMetrics) observeDriver(method string, start time.Time, response volume.Response) {
+	if metrics == nil {
+		return
+	}
+	result := "success"
+	if response.Err != "" {
+		result = "error"
+	}
+	metrics.driverRequests.inc(method, result)
+	metrics.driverLatency.observe(time.Since(start).Seconds(), method)
+}
+
+// observeAPI is the RequestObserver of the API client
+func (metrics *pluginMetrics) observeAPI(method string, duration time.Duration, err error) {
+	metrics.apiRequests.inc(method, resultOf(err))
+	metrics.apiLatency.observe(duration.Seconds(), method)
+}
+
+func (metrics *pluginMetrics) observeCreateWait(duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.createWait.observe(duration.Seconds())
+}
+
+// watchDriver adds the gauges which are read from the driver state on every scrape
+func (metrics *pluginMetrics) watchDriver(driver quobyteDriver) {
+	metrics.gauges = append(metrics.gauges,
+		gauge{
+			name: "quobyte_plugin_active_mounts",
+			help: "Number of volume mounts by containers on this host.",
+			collect: func() []gaugeSample {
+				return []gaugeSample{{value: float64(driver.state.activeMounts())}}
+			},
+		},
+		gauge{
+			name: "quobyte_plugin_namespace_mount_healthy",
+			help: "Whether the watched Quobyte namespace mount is healthy.",
+			collect: func() []gaugeSample {
+				if driver.watchdog == nil {
+					return nil
+				}
+				return []gaugeSample{{value: boolValue(driver.watchdog.err() == nil)}}
+			},
+		},
+		gauge{
+			name: "quobyte_plugin_api_endpoint_healthy",
+			help: "Whether the Quobyte API endpoint is used or skipped after failures.",
+			collect: func() []gaugeSample {
+				var samples []gaugeSample
+				for _, endpoint := range driver.client.EndpointStatus() {
+					samples = append(samples, gaugeSample{
+						labels: formatLabels([]string{"url"}, []string{endpoint.URL}),
+						value:  boolValue(endpoint.Healthy),
+					})
+				}
+				return samples
+			},
+		},
+	)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (metrics *pluginMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metrics.driverRequests.write(&buf)
+	metrics.driverLatency.write(&buf)
+	metrics.apiRequests.write(&buf)
+	metrics.apiLatency.write(&buf)
+	metrics.createWait.write(&buf)
+	for _, g := range metrics.gauges {
+		g.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := buf.WriteTo(w); err != nil {
+		logrus.Warnf("Unable to write metrics: %s", err)
+	}
+}
+
+// instrumentedDriver records the requests of the wrapped driver in metrics
+type instrumentedDriver struct {
+	driver  volume.Driver
+	metrics *pluginMetrics
+}
+
+func (d instrumentedDriver) Create(request volume.Request) volume.Response {
+	start := time.Now()
+	response := d.driver.Create(request)
+	d.metrics.observeDriver("Create", start, response)
+	return response
+}
+
+func (d instrumentedDriver) List(request volume.Request) volume.Response {
+	start := time.Now()
+	response := d.driver.List(request)
+	d.metrics.observeDriver("List", start, response)
+	return response
+}
+
+func (d instrumentedDriver) Get(request volume.Request) volume.Response {
+	start := time.Now()
+	response := d.driver.Get(request)
+	d.metrics.observeDriver("Get", start, response)
+	return response
+}
+
+func (d instrumentedDriver) Remove(request volume.Request) volume.Response {
+	start := time.Now()
+	response := d.driver.Remove(request)
+	d.metrics.observeDriver("Remove", start, response)
+	return response
+}
+
+func (d instrumentedDriver) Path(request volume.Request) volume.Response {
+	start := time.Now()
+	response := d.driver.Path(request)
+	d.metrics.observeDriver("Path", start, response)
+	return response
+}
+
+func (d instrumentedDriver) Mount(request volume.MountRequest) volume.Response {
+	start := time.Now()
+	response := d.driver.Mount(request)
+	d.metrics.observeDriver("Mount", start, response)
+	return response
+}
+
+func (d instrumentedDriver) Unmount(request volume.UnmountRequest) volume.Response {
+	start := time.Now()
+	response := d.driver.Unmount(request)
+	d.metrics.observeDriver("Unmount", start, response)
+	return response
+}
+
+func (d instrumentedDriver) Capabilities(request volume.Request) volume.Response {
+	start := time.Now()
+	response := d.driver.Capabilities(request)
+	d.metrics.observeDriver("Capabilities", start, response)
+	return response
+}
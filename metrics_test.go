@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	metrics := newPluginMetrics()
+	metrics.observeAPI("getVolumeList", 20*time.Millisecond, nil)
+	metrics.observeAPI("getVolumeList", 2*time.Second, errors.New("Timeout"))
+	metrics.observeCreateWait(3 * time.Second)
+
+	var buf bytes.Buffer
+	metrics.apiRequests.write(&buf)
+	metrics.apiLatency.write(&buf)
+	metrics.createWait.write(&buf)
+	got := buf.String()
+
+	expectedLines := []string{
+		"# TYPE quobyte_plugin_api_requests_total counter",
+		`quobyte_plugin_api_requests_total{method="getVolumeList",result="error"} 1`,
+		`quobyte_plugin_api_requests_total{method="getVolumeList",result="success"} 1`,
+		"# TYPE quobyte_plugin_api_request_duration_seconds histogram",
+		`quobyte_plugin_api_request_duration_seconds_bucket{method="getVolumeList",le="0.01"} 0`,
+		`quobyte_plugin_api_request_duration_seconds_bucket{method="getVolumeList",le="0.025"} 1`,
+		`quobyte_plugin_api_request_duration_seconds_bucket{method="getVolumeList",le="2.5"} 2`,
+		`quobyte_plugin_api_request_duration_seconds_bucket{method="getVolumeList",le="+Inf"} 2`,
+		`quobyte_plugin_api_request_duration_seconds_sum{method="getVolumeList"} 2.02`,
+		`quobyte_plugin_api_request_duration_seconds_count{method="getVolumeList"} 2`,
+		`quobyte_plugin_create_mount_wait_seconds_bucket{le="5"} 1`,
+		"quobyte_plugin_create_mount_wait_seconds_count 1",
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(got, line+"\n") {
+			log.Printf("Got:\n%s\nExpected line:\n%s\n", got, line)
+			t.FailNow()
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels([]string{"url", "method"}, []string{`http://"api"\`, "get"})
+	expected := `url="http://\"api\"\\",method="get"`
+	if got != expected {
+		log.Printf("Got:\n%s\nExpected:\n%s\n", got, expected)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// mountConfig describes how the Quobyte client is mounted
+type mountConfig struct {
+	// options are the FUSE options, e.g. "-o user_xattr"
+	options string
+	// registry is the list of registry servers in the form host[:port][,host:port] or a SRV record name
+	registry string
+	// useHelper calls the mount.quobyte helper directly instead of going through mount -t quobyte
+	useHelper bool
+	timeout   time.Duration
+}
+
+// mountError describes a failed mount command
+type mountError struct {
+	args     []string
+	output   string
+	timedOut bool
+	err      error
+}
+
+func (err *mountError) Error() string {
+	if err.timedOut {
+		return fmt.Sprintf("Mount command %q timed out: %s, output: %s", strings.Join(err.args, " "), err.err, err.output)
+	}
+	return fmt.Sprintf("Mount command %q failed: %s, output: %s", strings.Join(err.args, " "), err.err, err.output)
+}
+
+// splitArgs splits a command line into its arguments like a POSIX shell does, honoring
+// single and double quotes and backslash escapes, but without any expansion.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current bytes.Buffer
+	inArg, escaped := false, false
+	var quote rune
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote or escape in %q", line)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// mountCommand returns the argv mounting the Quobyte source (registry/[volume]) on target
+func mountCommand(config mountConfig, source, target string) ([]string, error) {
+	options, err := splitArgs(config.options)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.useHelper {
+		// mount helpers are called as mount.<type> <source> <target> [options]
+		return append([]string{"mount.quobyte", source, target}, options...), nil
+	}
+	args := append([]string{"mount"}, options...)
+	return append(args, "-t", "quobyte", source, target), nil
+}
+
+// runMount executes the mount command without a shell and kills it after the configured timeout
+func runMount(config mountConfig, source, target string) error {
+	args, err := mountCommand(config, source, target)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if config.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.timeout)
+	}
+	defer cancel()
+
+	logrus.WithField("target", target).Infof("Running %q", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return &mountError{
+			args:     args,
+			output:   strings.TrimSpace(string(out)),
+			timedOut: ctx.Err() == context.DeadlineExceeded,
+			err:      err,
+		}
+	}
+	return nil
+}
+
+// mountAll mounts all volumes of the Quobyte registry on mountQuobytePath
+func mountAll(config mountConfig, mountQuobytePath string) error {
+	return mountVolume(config, "", mountQuobytePath)
+}
+
+// mountVolume mounts a single Quobyte volume on target
+func mountVolume(config mountConfig, volumeName, target string) error {
+	registry, err := resolveRegistry(config.registry)
+	if err != nil {
+		return fmt.Errorf("Unable to resolve registry %s: %s", config.registry, err)
+	}
+	return runMount(config, registry+"/"+volumeName, target)
+}
+
+// bindMount makes source available at target, optionally read-only. Older kernels ignore
+// ro on the initial bind mount, so it is applied with a second remount.
+func bindMount(source, target string, readOnly bool) error {
+	if err := runCommand("mount", "--bind", source, target); err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	if err := runCommand("mount", "-o", "remount,bind,ro", target); err != nil {
+		// Never leave a writable bind mount behind
+		unmount(target, true)
+		return err
+	}
+	return nil
+}
+
+func runCommand(args ...string) error {
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return &mountError{args: args, output: strings.TrimSpace(string(out)), err: err}
+	}
+	return nil
+}
+
+// unmount unmounts target. A lazy unmount detaches the mount even if it is busy or stale.
+func unmount(target string, lazy bool) error {
+	if lazy {
+		return runCommand("umount", "-l", target)
+	}
+	return runCommand("umount", target)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	expectedResults := map[string][]string{
+		"-o user_xattr":          {"-o", "user_xattr"},
+		"  -o   user_xattr,acl ": {"-o", "user_xattr,acl"},
+		`-o "a b" 'c;$(d)' e\ f`: {"-o", "a b", "c;$(d)", "e f"},
+		`-o x;rm -rf /`:          {"-o", "x;rm", "-rf", "/"},
+		"":                       nil,
+		`""`:                     {""},
+	}
+
+	for line, res := range expectedResults {
+		got, err := splitArgs(line)
+		if err != nil || !reflect.DeepEqual(got, res) {
+			log.Printf("Got:\n%q (%v)\nExpected:\n%q\nLine:\n%s\n", got, err, res, line)
+			t.FailNow()
+		}
+	}
+
+	for _, line := range []string{`-o "user_xattr`, `-o user_xattr\`} {
+		if _, err := splitArgs(line); err == nil {
+			log.Printf("Expected error for %q\n", line)
+			t.FailNow()
+		}
+	}
+}
+
+func TestMountCommand(t *testing.T) {
+	config := mountConfig{options: "-o user_xattr"}
+	got, _ := mountCommand(config, "registry:7861/", "/mnt/quobyte")
+	expected := []string{"mount", "-o", "user_xattr", "-t", "quobyte", "registry:7861/", "/mnt/quobyte"}
+	if !reflect.DeepEqual(got, expected) {
+		log.Printf("Got:\n%q\nExpected:\n%q\n", got, expected)
+		t.FailNow()
+	}
+
+	config.useHelper = true
+	got, _ = mountCommand(config, "registry:7861/", "/mnt/quobyte")
+	expected = []string{"mount.quobyte", "registry:7861/", "/mnt/quobyte", "-o", "user_xattr"}
+	if !reflect.DeepEqual(got, expected) {
+		log.Printf("Got:\n%q\nExpected:\n%q\n", got, expected)
+		t.FailNow()
+	}
+}
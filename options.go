@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// volumeOptions holds the parsed options of a volume create request
+type volumeOptions struct {
+	user              string
+	group             string
+	configurationName string
+	tenantID          string
+	deletionPolicy    string
+	quotaBytes        uint64
+	quotaFiles        uint64
+	readOnly          bool
+	acl               bool
+	userXattr         bool
+	directIO          bool
+}
+
+// fuseOptions returns the FUSE options of the volumes own mount requested through the create options
+func (opts volumeOptions) fuseOptions() string {
+	var flags []string
+	if opts.userXattr {
+		flags = append(flags, "user_xattr")
+	}
+	if opts.acl {
+		flags = append(flags, "acl")
+	}
+	if opts.directIO {
+		flags = append(flags, "direct_io")
+	}
+
+	if len(flags) == 0 {
+		return ""
+	}
+	return "-o " + strings.Join(flags, ",")
+}
+
+// volumeFuseFlags are the FUSE options a volume can request for its own mount
+var volumeFuseFlags = map[string]bool{
+	"user_xattr": true,
+	"acl":        true,
+	"direct_io":  true,
+}
+
+// checkFuseOptions validates recorded FUSE options before they are passed to the mount
+// command. Labels can be changed by anyone with access to the API, so only -o with the
+// flags of volumeFuseFlags is accepted.
+func checkFuseOptions(options string) error {
+	args, err := splitArgs(options)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(args); i += 2 {
+		if args[i] != "-o" || i+1 == len(args) {
+			return fmt.Errorf("Invalid mount options %q", options)
+		}
+		for _, flag := range strings.Split(args[i+1], ",") {
+			if !volumeFuseFlags[flag] {
+				return fmt.Errorf("Invalid mount option %q", flag)
+			}
+		}
+	}
+	return nil
+}
+
+// optionSpec describes a supported create option and how its value is parsed
+type optionSpec struct {
+	description string
+	parse       func(value string, opts *volumeOptions) error
+}
+
+var createOptionSpecs = map[string]optionSpec{
+	"user": {
+		description: "owner of the volumes root directory",
+		parse: func(value string, opts *volumeOptions) error {
+			opts.user = value
+			return requireValue(value)
+		},
+	},
+	"group": {
+		description: "group of the volumes root directory",
+		parse: func(value string, opts *volumeOptions) error {
+			opts.group = value
+			return requireValue(value)
+		},
+	},
+	"configuration_name": {
+		description: "volume configuration of the new volume",
+		parse: func(value string, opts *volumeOptions) error {
+			opts.configurationName = value
+			return requireValue(value)
+		},
+	},
+	"tenant_id": {
+		description: "tenant of the new volume",
+		parse: func(value string, opts *volumeOptions) error {
+			opts.tenantID = value
+			return requireValue(value)
+		},
+	},
+	"deletion_policy": {
+		description: "delete, retain, retain-if-not-created-by-plugin or trash",
+		parse: func(value string, opts *volumeOptions) error {
+			opts.deletionPolicy = value
+			return validateDeletionPolicy(value)
+		},
+	},
+	"readonly": {
+		description: "true exposes the volume read-only to containers",
+		parse: func(value string, opts *volumeOptions) error {
+			return parseBoolOption(value, &opts.readOnly)
+		},
+	},
+	"acl": {
+		description: "true enables POSIX ACLs on the volumes own mount",
+		parse: func(value string, opts *volumeOptions) error {
+			return parseBoolOption(value, &opts.acl)
+		},
+	},
+	"user_xattr": {
+		description: "true enables user extended attributes on the volumes own mount",
+		parse: func(value string, opts *volumeOptions) error {
+			return parseBoolOption(value, &opts.userXattr)
+		},
+	},
+	"cache": {
+		description: "default uses the page cache of the host, none bypasses it on the volumes own mount",
+		parse: func(value string, opts *volumeOptions) error {
+			switch value {
+			case "default":
+				opts.directIO = false
+			case "none":
+				opts.directIO = true
+			default:
+				return fmt.Errorf("expected default or none")
+			}
+			return nil
+		},
+	},
+	"size": {
+		description: "quota of the volume, e.g. 10GiB",
+		parse:       parseQuotaBytes,
+	},
+	"quota": {
+		description: "alias for size",
+		parse:       parseQuotaBytes,
+	},
+	"max_files": {
+		description: "maximum number of files in the volume",
+		parse: func(value string, opts *volumeOptions) error {
+			count, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("expected a positive number")
+			}
+			opts.quotaFiles = count
+			return nil
+		},
+	},
+}
+
+// volumeQuotaOptions are the create options which set the quota of the whole Quobyte volume
+var volumeQuotaOptions = map[string]bool{
+	"size":      true,
+	"quota":     true,
+	"max_files": true,
+}
+
+func requireValue(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("value must not be empty")
+	}
+	return nil
+}
+
+func parseBoolOption(value string, target *bool) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("expected true or false")
+	}
+	*target = parsed
+	return nil
+}
+
+func parseQuotaBytes(value string, opts *volumeOptions) error {
+	bytes, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	opts.quotaBytes = bytes
+	return nil
+}
+
+// validOptionNames returns the sorted names of all supported create options
+func validOptionNames() []string {
+	var names []string
+	for name := range createOptionSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseVolumeOptions validates the create options of a request against createOptionSpecs
+// and applies them on top of defaults. Unknown or malformed options are rejected.
+func parseVolumeOptions(options map[string]string, defaults volumeOptions) (volumeOptions, error) {
+	opts := defaults
+
+	var unknown []string
+	for key := range options {
+		if _, ok := createOptionSpecs[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return opts, fmt.Errorf("Unknown option(s) %s, valid options are %s",
+			strings.Join(unknown, ", "), strings.Join(validOptionNames(), ", "))
+	}
+
+	// Parse in a fixed order so the same option always wins, e.g. quota over size
+	for _, key := range validOptionNames() {
+		value, ok := options[key]
+		if !ok {
+			continue
+		}
+		if err := createOptionSpecs[key].parse(value, &opts); err != nil {
+			return opts, fmt.Errorf("Invalid value %q for option %s (%s): %s",
+				value, key, createOptionSpecs[key].description, err)
+		}
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseVolumeOptions(t *testing.T) {
+	defaults := volumeOptions{user: "root", group: "root", configurationName: "BASE", tenantID: "tenant"}
+
+	opts, err := parseVolumeOptions(map[string]string{
+		"user":               "docker",
+		"configuration_name": "SSD",
+		"size":               "10GiB",
+		"max_files":          "1000",
+	}, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := volumeOptions{user: "docker", group: "root", configurationName: "SSD", tenantID: "tenant",
+		quotaBytes: 10 << 30, quotaFiles: 1000}
+	if opts != expected {
+		log.Printf("Got:\n%+v\nExpected:\n%+v\n", opts, expected)
+		t.FailNow()
+	}
+
+	expectedErrors := map[string]map[string]string{
+		"Unknown option(s) confguration_name, valid options are acl, cache, configuration_name": {"confguration_name": "SSD"},
+		"Invalid value \"\" for option user":                                                    {"user": ""},
+		"Invalid value \"many\" for option max_files":                                           {"max_files": "many"},
+		"Invalid value \"keep\" for option deletion_policy":                                     {"deletion_policy": "keep"},
+		"Invalid value \"yes please\" for option readonly":                                      {"readonly": "yes please"},
+		"Invalid value \"all\" for option cache":                                                {"cache": "all"},
+	}
+	for res, options := range expectedErrors {
+		_, got := parseVolumeOptions(options, defaults)
+		if got == nil || !strings.HasPrefix(got.Error(), res) {
+			log.Printf("Got:\n%v\nExpected prefix:\n%s\n", got, res)
+			t.FailNow()
+		}
+	}
+}
+
+func TestFuseOptions(t *testing.T) {
+	defaults := volumeOptions{}
+	expectedResults := map[string]map[string]string{
+		"":                        {"readonly": "true"},
+		"-o user_xattr,acl":       {"acl": "true", "user_xattr": "true"},
+		"-o direct_io":            {"cache": "none"},
+		"-o user_xattr,direct_io": {"cache": "none", "acl": "false", "user_xattr": "true"},
+	}
+
+	for res, options := range expectedResults {
+		opts, err := parseVolumeOptions(options, defaults)
+		if err != nil || opts.fuseOptions() != res {
+			log.Printf("Got:\n%s (%v)\nExpected:\n%s\n", opts.fuseOptions(), err, res)
+			t.FailNow()
+		}
+	}
+}
+
+func TestCheckFuseOptions(t *testing.T) {
+	expectedResults := map[string]bool{
+		"":                            true,
+		"-o user_xattr,acl":           true,
+		"-o user_xattr -o direct_io":  true,
+		"-o noatime":                  false,
+		"-o acl --allow-other":        false,
+		"-o acl -o":                   false,
+		"--registry evil:7861":        false,
+		"-o \"acl,user_xattr\" 'acl'": false,
+	}
+
+	for options, valid := range expectedResults {
+		if got := checkFuseOptions(options); (got == nil) != valid {
+			log.Printf("Got:\n%v\nExpected valid:\n%v\nOptions:\n%s\n", got, valid, options)
+			t.FailNow()
+		}
+	}
+}
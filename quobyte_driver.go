@@ -2,199 +2,951 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"log"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	quobyte_api "github.com/quobyte/api"
 )
 
+const (
+	// deletionPolicyDelete deletes the Quobyte volume on removal
+	deletionPolicyDelete string = "delete"
+	// deletionPolicyRetain keeps the Quobyte volume and only forgets it on the Docker side
+	deletionPolicyRetain string = "retain"
+	// deletionPolicyRetainForeign deletes only volumes which were created by the plugin
+	deletionPolicyRetainForeign string = "retain-if-not-created-by-plugin"
+	// deletionPolicyTrash renames the Quobyte volume so it can be purged later
+	deletionPolicyTrash string = "trash"
+
+	trashPrefix string = ".trash-"
+)
+
+func validateDeletionPolicy(policy string) error {
+	switch policy {
+	case deletionPolicyDelete, deletionPolicyRetain, deletionPolicyRetainForeign, deletionPolicyTrash:
+		return nil
+	}
+	return fmt.Errorf("Unknown deletion policy %q, valid policies are %s, %s, %s and %s", policy,
+		deletionPolicyDelete, deletionPolicyRetain, deletionPolicyRetainForeign, deletionPolicyTrash)
+}
+
 type quobyteDriver struct {
 	client       *quobyte_api.QuobyteClient
 	quobyteMount string
-	m            *sync.Mutex
+	locks        *volumeLocks
 	maxFSChecks  int
 	maxWaitTime  float64
 	tenantID     string
 	configName   string
+	state        *pluginState
+	// deletionPolicy is the default policy for volumes without a deletion_policy option
+	deletionPolicy string
+	// tenantDefaults are the default create options per tenant
+	tenantDefaults map[string]map[string]string
+	// settings holds the reloadable settings, they are copied into the driver for each request,
+	// it is nil if the settings can not change
+	settings *settingsStore
+	// watchdog reports the health of the Quobyte mount, it is nil if the mount is not watched
+	watchdog *mountWatchdog
+	// mounter mounts every volume on its own below quobyteMount, it is nil if a single
+	// multi-volume mount of the Quobyte namespace is used
+	mounter perVolumeMounter
+	// readOnlyMount is the directory below which volumes created with readonly=true are bind mounted
+	readOnlyMount string
+	// metrics records driver and API metrics, it is nil if metrics are disabled
+	metrics *pluginMetrics
+	// log carries the fields of the request the driver copy is handling
+	log *logrus.Entry
 }
 
-func newQuobyteDriver(apiURL string, username string, password string, quobyteMount string, maxFSChecks int, maxWaitTime float64, fconfigName string, fTenantID string) quobyteDriver {
+func newQuobyteDriver(apiURL string, username string, password string, quobyteMount string, maxFSChecks int, maxWaitTime float64, fconfigName string, fTenantID string, deletionPolicy string, state *pluginState) quobyteDriver {
 	driver := quobyteDriver{
 		client:       quobyte_api.NewQuobyteClient(apiURL, username, password),
 		quobyteMount: quobyteMount,
-		m:            &sync.Mutex{},
+		locks:        newVolumeLocks(),
 		maxFSChecks:  maxFSChecks,
 		maxWaitTime:  maxWaitTime,
 		tenantID:     fTenantID,
 		configName:   fconfigName,
+		state:        state,
+
+		deletionPolicy: deletionPolicy,
+		log:            logrus.NewEntry(logrus.StandardLogger()),
 	}
 
 	return driver
 }
 
-func (driver quobyteDriver) stripVolumeName(requestName string) (strippedVolumeName string, subdirPath string) {
+// withRequest returns a copy of the driver whose log lines and API calls carry the
+// operation, the Docker volume and a new request ID
+func (driver quobyteDriver) withRequest(op, name string) quobyteDriver {
+	id := newRequestID()
+	fields := logrus.Fields{"op": op, "request_id": id}
+	if name != "" {
+		fields["volume"] = name
+	}
+	driver.log = logrus.WithFields(fields)
+	driver.client = driver.client.WithRequestID(id).WithLogger(driver.log)
+	if driver.settings != nil {
+		settings := driver.settings.get()
+		driver.tenantID = settings.tenantID
+		driver.configName = settings.configName
+		driver.tenantDefaults = settings.tenantDefaults
+	}
+	return driver
+}
+
+// stripVolumeName splits a Docker volume name into the Quobyte volume and the subdirectory in
+// it. Docker does not validate the names of plugin volumes, so names which would leave the
+// volume, like vol/.. or ../vol, are rejected.
+func (driver quobyteDriver) stripVolumeName(requestName string) (strippedVolumeName string, subdirPath string, err error) {
 	nameElems := strings.SplitN(requestName, "/", 2)
-	if len(nameElems) == 2 {
-		subDir := path.Clean(nameElems[1])
-		return nameElems[0], subDir
+	volumeName := nameElems[0]
+	if volumeName == "" || volumeName == "." || volumeName == ".." {
+		return "", "", fmt.Errorf("Invalid volume name %q", requestName)
+	}
+	if len(nameElems) == 1 {
+		return volumeName, "", nil
+	}
+
+	subDir := path.Clean(nameElems[1])
+	if subDir == "." {
+		return volumeName, "", nil
+	}
+	if path.IsAbs(subDir) || subDir == ".." || strings.HasPrefix(subDir, "../") {
+		return "", "", fmt.Errorf("Invalid subdirectory %s of volume %s, it must stay inside the volume", nameElems[1], volumeName)
 	}
-	return nameElems[0], ""
+	volumePath := filepath.Join(driver.quobyteMount, volumeName)
+	if rel, err := filepath.Rel(volumePath, filepath.Join(volumePath, subDir)); err != nil || rel != subDir {
+		return "", "", fmt.Errorf("Invalid subdirectory %s of volume %s, it must stay inside the volume", nameElems[1], volumeName)
+	}
+	return volumeName, subDir, nil
+}
+
+// mountPoint returns the path of a Docker volume, which is either a Quobyte volume or a
+// subdirectory in it. Names have to be checked with stripVolumeName first, for invalid names
+// the path of an unused directory inside the mount is returned.
+func (driver quobyteDriver) mountPoint(name string) string {
+	volumeName, subDirs, err := driver.stripVolumeName(name)
+	if err != nil {
+		return filepath.Join(driver.quobyteMount, ".invalid")
+	}
+	return filepath.Join(driver.quobyteMount, volumeName, subDirs)
+}
+
+// checkSubdirPath makes sure the subdirectory of a Docker volume does not leave its Quobyte
+// volume through symlinks, which stripVolumeName can not see in the name alone. Missing parts
+// of the path are fine, they are created as directories.
+func (driver quobyteDriver) checkSubdirPath(name string) error {
+	volumeName, subDirs, err := driver.stripVolumeName(name)
+	if err != nil || subDirs == "" {
+		return err
+	}
+	volumePath, err := filepath.EvalSymlinks(filepath.Join(driver.quobyteMount, volumeName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Resolve the longest existing part of the path, a dangling symlink counts as existing
+	existing, missing := filepath.Join(volumePath, subDirs), ""
+	for existing != volumePath {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fmt.Errorf("Invalid subdirectory %s of volume %s: %s", subDirs, volumeName, err)
+	}
+	rel, err := filepath.Rel(volumePath, filepath.Join(resolved, missing))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("Invalid subdirectory %s of volume %s, it must stay inside the volume", subDirs, volumeName)
+	}
+	return nil
+}
+
+// readOnlyPath returns the read-only bind mount of a Docker volume. The name is escaped so
+// subdirectory volumes never end up inside the read-only bind mount of their volume.
+func (driver quobyteDriver) readOnlyPath(name string) string {
+	return filepath.Join(driver.readOnlyMount, url.PathEscape(name))
+}
+
+// containerPath returns the path handed out to containers using the Docker volume
+func (driver quobyteDriver) containerPath(name string) string {
+	if record, _ := driver.state.volume(name); record.ReadOnly {
+		return driver.readOnlyPath(name)
+	}
+	return driver.mountPoint(name)
+}
+
+// apiError turns an error of the Quobyte API into the message returned to Docker
+func apiError(action, subject string, err error) string {
+	switch {
+	case quobyte_api.IsNotFound(err):
+		return fmt.Sprintf("Unable to %s %s, it does not exist: %s", action, subject, err)
+	case quobyte_api.IsPermissionDenied(err):
+		return fmt.Sprintf("Unable to %s %s, permission denied for the API user: %s", action, subject, err)
+	case quobyte_api.IsTimeout(err):
+		return fmt.Sprintf("Unable to %s %s, the Quobyte API did not answer in time: %s", action, subject, err)
+	case quobyte_api.IsConnectionFailure(err):
+		return fmt.Sprintf("Unable to %s %s, the Quobyte API is unreachable: %s", action, subject, err)
+	}
+	return fmt.Sprintf("Unable to %s %s: %s", action, subject, err)
+}
+
+// tenantOf returns the tenant a Docker volume was created in, falling back to the plugins tenant
+func (driver quobyteDriver) tenantOf(name string) string {
+	if record, ok := driver.state.volume(name); ok && record.TenantID != "" {
+		return record.TenantID
+	}
+	return driver.tenantID
+}
+
+// createOptions adds the default create options of the volumes tenant to options. Default
+// quotas are left out for subdirectory volumes, they would limit the whole Quobyte volume.
+func (driver quobyteDriver) createOptions(options map[string]string, subdir bool) map[string]string {
+	tenantID := driver.tenantID
+	if value, ok := options["tenant_id"]; ok {
+		tenantID = value
+	}
+	defaults := driver.tenantDefaults[tenantID]
+	if len(defaults) == 0 {
+		return options
+	}
+
+	merged := make(map[string]string, len(defaults)+len(options))
+	for key, value := range defaults {
+		if subdir && volumeQuotaOptions[key] {
+			continue
+		}
+		merged[key] = value
+	}
+	for key, value := range options {
+		merged[key] = value
+	}
+	return merged
 }
 
 func (driver quobyteDriver) Create(request volume.Request) volume.Response {
-	driver.m.Lock()
-	defer driver.m.Unlock()
+	driver = driver.withRequest("Create", request.Name)
+	volumeName, subDirs, err := driver.stripVolumeName(request.Name)
+	if err != nil {
+		driver.log.Warn(err)
+		return volume.Response{Err: err.Error()}
+	}
+	defer driver.locks.lock(volumeName)()
 
-	volumeName, subDirs := driver.stripVolumeName(request.Name)
 	if subDirs == "" {
-		log.Printf("Creating volume %s\n", volumeName)
+		driver.log.Infof("Creating volume %s", volumeName)
 	} else {
-		log.Printf("Creating volume %s with subdir(s) %s\n", volumeName, subDirs)
+		driver.log.Infof("Creating volume %s with subdir(s) %s", volumeName, subDirs)
 	}
 
-	user, group := "root", "root"
-	configurationName := driver.configName
-	retryPolicy := "INTERACTIVE"
-	tenantID := driver.tenantID
-
-	if usr, ok := request.Options["user"]; ok {
-		user = usr
+	if subDirs != "" {
+		for key := range request.Options {
+			if volumeQuotaOptions[key] {
+				err := fmt.Errorf("Option %s can not be used for subdirectory volume %s, quotas apply to the whole Quobyte volume %s", key, request.Name, volumeName)
+				driver.log.Warn(err)
+				return volume.Response{Err: err.Error()}
+			}
+		}
 	}
-	if grp, ok := request.Options["group"]; ok {
-		group = grp
+	options := driver.createOptions(request.Options, subDirs != "")
+	opts, err := parseVolumeOptions(options, volumeOptions{
+		user:              "root",
+		group:             "root",
+		configurationName: driver.configName,
+		tenantID:          driver.tenantID,
+	})
+	if err != nil {
+		driver.log.Warn(err)
+		return volume.Response{Err: err.Error()}
+	}
+	if err := driver.validateBackendOptions(options, opts); err != nil {
+		driver.log.Warn(err)
+		return volume.Response{Err: err.Error()}
 	}
-	if conf, ok := request.Options["configuration_name"]; ok {
-		configurationName = conf
+	if opts.fuseOptions() != "" && driver.mounter == nil {
+		return volume.Response{Err: fmt.Sprintf("Mount options of a single volume require the %s mount mode", mountModePerVolume)}
 	}
-	if tenant, ok := request.Options["tenant_id"]; ok {
-		tenantID = tenant
+	if opts.readOnly && driver.readOnlyMount == "" {
+		return volume.Response{Err: "Read-only volumes are not supported, no directory for read-only mounts is configured"}
 	}
+	retryPolicy := "INTERACTIVE"
+	tenantID := opts.tenantID
+	driver.log = driver.log.WithField("tenant", tenantID)
 
-	if _, err := driver.client.CreateVolume(&quobyte_api.CreateVolumeRequest{
+	created := true
+	volumeUUID, err := driver.client.CreateVolume(&quobyte_api.CreateVolumeRequest{
 		Name:              volumeName,
-		RootUserID:        user,
-		RootGroupID:       group,
-		ConfigurationName: configurationName,
+		RootUserID:        opts.user,
+		RootGroupID:       opts.group,
+		ConfigurationName: opts.configurationName,
 		TenantID:          tenantID,
 		Retry:             retryPolicy,
-	}); err != nil {
-		log.Println(err)
+	})
+	if err != nil {
+		if !quobyte_api.IsEntityExists(err) {
+			driver.log.Error(err)
+			return volume.Response{Err: apiError("create", "volume "+volumeName, err)}
+		}
+		driver.log.Infof("Volume %s already exists", volumeName)
+		created = false
+	}
 
-		if !strings.Contains(err.Error(), "ENTITY_EXISTS_ALREADY/POSIX_ERROR_NONE") {
-			return volume.Response{Err: err.Error()}
+	if !created {
+		if volumeUUID, err = driver.client.ResolveVolumeNameToUUID(volumeName, tenantID); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: apiError("resolve", "volume "+volumeName, err)}
+		}
+	}
+	if opts.quotaBytes > 0 || opts.quotaFiles > 0 {
+		driver.log.Infof("Setting quota of volume %s to %d bytes and %d files", volumeName, opts.quotaBytes, opts.quotaFiles)
+		if err := driver.client.SetVolumeQuota(volumeUUID, opts.quotaBytes, opts.quotaFiles); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: fmt.Sprintf("Unable to set quota of volume %s: %s", volumeName, err)}
 		}
 	}
 
 	mPoint := filepath.Join(driver.quobyteMount, volumeName)
-	log.Printf("Validate mounting volume %s on %s\n", volumeName, mPoint)
-	if err := driver.checkMountPoint(mPoint); err != nil {
+	driver.log.Debugf("Validate mounting volume %s on %s", volumeName, mPoint)
+	probe := func() error { return probeMountPoint(mPoint) }
+	if driver.mounter != nil {
+		// The new volume is available once it can be mounted on its own
+		probe = func() error { return driver.mounter.mount(volumeName, opts.fuseOptions()) }
+		defer driver.releaseVolumeMount(volumeName)
+	}
+	if err := driver.checkMountPoint(mPoint, probe); err != nil {
+		driver.log.Error(err)
 		return volume.Response{Err: err.Error()}
 	}
 
 	if subDirs != "" {
-		log.Printf("Creating subdir(s) %s for new volume %s\n", subDirs, volumeName)
-		if csdErr := os.MkdirAll(filepath.Join(mPoint, subDirs), 0755); csdErr != nil {
-			log.Printf("Unable to create subdirs in new volume: %s", csdErr)
+		// A subdirectory volume counts as created by the plugin if the subdirectory did not exist before
+		subdirPath := driver.mountPoint(request.Name)
+		if err := driver.checkSubdirPath(request.Name); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		_, statErr := os.Stat(subdirPath)
+		created = os.IsNotExist(statErr)
+		driver.log.Infof("Creating subdir(s) %s for volume %s", subDirs, volumeName)
+		if csdErr := os.MkdirAll(subdirPath, 0755); csdErr != nil {
+			driver.log.Errorf("Unable to create subdirs in volume: %s", csdErr)
+			return volume.Response{Err: csdErr.Error()}
 		}
 	}
 
+	record, _ := driver.state.volume(request.Name)
+	if vol, err := driver.client.GetVolumeByUUID(volumeUUID); err == nil {
+		record, _ = driver.recordOf(request.Name, vol)
+	}
+	record.TenantID = tenantID
+	record.CreatedByPlugin = record.CreatedByPlugin || created
+	record.Retained = false
+	if opts.deletionPolicy != "" {
+		record.DeletionPolicy = opts.deletionPolicy
+	}
+	if fuseOptions := opts.fuseOptions(); fuseOptions != "" {
+		record.MountOptions = fuseOptions
+	}
+	if _, ok := options["readonly"]; ok {
+		record.ReadOnly = opts.readOnly
+	}
+	if err := driver.storeRecord(request.Name, volumeUUID, record); err != nil {
+		driver.log.Error(err)
+		return volume.Response{Err: apiError("store the settings of", "volume "+request.Name, err)}
+	}
+
 	return volume.Response{Err: ""}
 }
 
-func (driver quobyteDriver) checkMountPoint(mPoint string) error {
+// validateBackendOptions checks the explicitly requested configuration and tenant exist in Quobyte.
+// If the backend cannot be queried the check is skipped and left to the createVolume call.
+func (driver quobyteDriver) validateBackendOptions(options map[string]string, opts volumeOptions) error {
+	if _, ok := options["configuration_name"]; ok {
+		configs, err := driver.client.GetVolumeConfigurations()
+		if err != nil {
+			driver.log.Warnf("Unable to validate configuration_name: %s", err)
+		} else if !hasConfiguration(configs, opts.configurationName) {
+			var names []string
+			for _, config := range configs {
+				names = append(names, config.ConfigurationName)
+			}
+			return fmt.Errorf("Unknown configuration_name %q, available configurations are %s",
+				opts.configurationName, strings.Join(names, ", "))
+		}
+	}
+
+	if _, ok := options["tenant_id"]; ok {
+		tenants, err := driver.client.GetTenants()
+		if err != nil {
+			driver.log.Warnf("Unable to validate tenant_id: %s", err)
+		} else if !hasTenant(tenants, opts.tenantID) {
+			return fmt.Errorf("Unknown tenant_id %q", opts.tenantID)
+		}
+	}
+
+	return nil
+}
+
+func hasConfiguration(configs []quobyte_api.VolumeConfiguration, name string) bool {
+	for _, config := range configs {
+		if config.ConfigurationName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTenant(tenants []quobyte_api.Tenant, tenantID string) bool {
+	for _, tenant := range tenants {
+		if tenant.TenantID == tenantID || tenant.Name == tenantID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMountPoint runs probe with exponential backoff until it succeeds or maxFSChecks
+// or maxWaitTime are exceeded
+func (driver quobyteDriver) checkMountPoint(mPoint string, probe func() error) error {
+	start := time.Now()
+	maxWait := time.Duration(driver.maxWaitTime * float64(time.Second))
+	maxChecks := driver.maxFSChecks
+	if maxChecks < 1 {
+		maxChecks = 1
+	}
+
+	var err error
+	attempt := 0
+	for attempt < maxChecks {
+		attempt++
+		if err = probe(); err == nil {
+			driver.log.Infof("Validated new volume ok: %s (%d checks)", mPoint, attempt)
+			driver.metrics.observeCreateWait(time.Since(start))
+			return nil
+		}
+		driver.log.Infof("Volume %s not available yet (check %d/%d): %s", mPoint, attempt, maxChecks, err)
+
+		remaining := maxWait - time.Since(start)
+		if attempt == maxChecks || remaining <= 0 {
+			break
+		}
+		delay := backoffDelay(attempt)
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+	}
+
+	return fmt.Errorf("Volume %s did not become available after %d checks in %.1f seconds: %s",
+		mPoint, attempt, time.Since(start).Seconds(), err)
+}
+
+func probeMountPoint(mPoint string) error {
 	// Trigger volume list refresh
 	mkdErr := os.Mkdir(mPoint, 0755)
-	if !os.IsExist(mkdErr) {
+	if mkdErr != nil && !os.IsExist(mkdErr) {
 		// we expected ErrExist, everything else is an error
 		return mkdErr
 	}
-	// NOTE(kaisers): Workaround for issue #9727, remove when #9628 has been implemented
-	time.Sleep(1 * time.Second)
 
 	// Verify volume is available
 	_, statErr := os.Stat(mPoint)
-	if statErr != nil {
-		return statErr
-	}
-	log.Printf("Validated new volume ok: %s\n", mPoint)
-	return nil
+	return statErr
 }
 
 func (driver quobyteDriver) Remove(request volume.Request) volume.Response {
-	driver.m.Lock()
-	defer driver.m.Unlock()
-
-	volumeName, _ := driver.stripVolumeName(request.Name)
-	log.Printf("Removing volume %s\n", volumeName)
-	if err := driver.client.DeleteVolumeByName(volumeName, driver.tenantID); err != nil {
-		log.Println(err)
+	driver = driver.withRequest("Remove", request.Name)
+	volumeName, subDirs, err := driver.stripVolumeName(request.Name)
+	if err != nil {
+		driver.log.Warn(err)
 		return volume.Response{Err: err.Error()}
 	}
+	defer driver.locks.lock(volumeName)()
+
+	// Docker only removes volumes no container references, so recorded mounts of this volume
+	// are left over from containers which died without an Unmount, e.g. when the plugin was
+	// not running. Subdirectory volumes are separate Docker volumes which may still be in use.
+	stale, err := driver.state.dropMounts(request.Name)
+	if err != nil {
+		driver.log.Errorf("Unable to persist mount state: %s", err)
+	}
+	if len(stale) > 0 {
+		driver.log.Warnf("Dropping stale mounts of container(s) %s", strings.Join(stale, ", "))
+		driver.releaseReadOnlyMount(request.Name)
+	}
+	if subDirs == "" {
+		if containers := driver.state.containers(request.Name); len(containers) > 0 {
+			driver.log.Warnf("Refusing to remove volume %s, its subdirectory volumes are in use by container(s) %s", request.Name, strings.Join(containers, ", "))
+			return volume.Response{Err: fmt.Sprintf("volume %s has subdirectory volumes in use by container(s) %s", request.Name, strings.Join(containers, ", "))}
+		}
+		driver.releaseVolumeMount(volumeName)
+	}
+
+	tenantID := driver.tenantOf(request.Name)
+	driver.log = driver.log.WithField("tenant", tenantID)
+	vol, err := driver.client.GetVolume(volumeName, tenantID)
+	if err != nil {
+		if !quobyte_api.IsNotFound(err) {
+			driver.log.Error(err)
+			return volume.Response{Err: apiError("get", "volume "+volumeName, err)}
+		}
+		if subDirs == "" {
+			// A volume which is already gone in Quobyte only needs to be forgotten by Docker
+			driver.log.Infof("Volume %s is already gone: %s", volumeName, err)
+			if err := driver.state.forget(request.Name); err != nil {
+				driver.log.Errorf("Unable to persist mount state: %s", err)
+			}
+			return volume.Response{Err: ""}
+		}
+	}
+
+	policy := driver.deletionPolicy
+	record, known := driver.recordOf(request.Name, vol)
+	if record.DeletionPolicy != "" {
+		policy = record.DeletionPolicy
+	}
+	if !known {
+		// Without record the policy the volume was created with is unknown, e.g. it was not
+		// created through the plugin, so it is kept
+		driver.log.Infof("No record of volume %s, retaining it", request.Name)
+		policy = deletionPolicyRetain
+	}
+	if policy == deletionPolicyRetainForeign {
+		policy = deletionPolicyDelete
+		if !record.CreatedByPlugin {
+			policy = deletionPolicyRetain
+		}
+	}
+
+	if policy == deletionPolicyRetain {
+		if subDirs == "" {
+			driver.log.Infof("Retaining volume %s, only removing it from Docker", volumeName)
+		} else {
+			driver.log.Infof("Retaining subdirectory %s, only removing it from Docker", driver.mountPoint(request.Name))
+		}
+		// The volume still exists in Quobyte, so List would hand it to Docker again. The record
+		// hides it and keeps it retained on all hosts, even if it is removed again or the
+		// default policy changes.
+		record.Retained = true
+		if record.DeletionPolicy == "" {
+			record.DeletionPolicy = deletionPolicyRetain
+		}
+		if vol.VolumeUUID == "" {
+			if err := driver.state.setVolume(request.Name, record); err != nil {
+				driver.log.Errorf("Unable to persist volume state: %s", err)
+			}
+		} else if err := driver.storeRecord(request.Name, vol.VolumeUUID, record); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: apiError("store the settings of", "volume "+request.Name, err)}
+		}
+		return volume.Response{Err: ""}
+	}
+
+	if subDirs != "" {
+		if driver.mounter != nil {
+			if err := driver.mountVolume(request.Name, volumeName); err != nil {
+				driver.log.Error(err)
+				return volume.Response{Err: err.Error()}
+			}
+			defer driver.releaseVolumeMount(volumeName)
+		}
+		if err := driver.checkSubdirPath(request.Name); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		if err := driver.removeSubdir(request.Name, policy); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		if vol.VolumeUUID != "" {
+			if err := driver.client.DeleteVolumeLabel(vol.VolumeUUID, recordLabelName(subDirs)); err != nil {
+				driver.log.Errorf("Unable to remove the settings of volume %s: %s", request.Name, err)
+			}
+		}
+		if err := driver.state.forget(request.Name); err != nil {
+			driver.log.Errorf("Unable to persist mount state: %s", err)
+		}
+		return volume.Response{Err: ""}
+	}
+
+	switch policy {
+	case deletionPolicyTrash:
+		trashName := fmt.Sprintf("%s%d-%s", trashPrefix, time.Now().Unix(), volumeName)
+		driver.log.Infof("Moving volume %s to trash as %s", volumeName, trashName)
+		if err := driver.client.RenameVolume(vol.VolumeUUID, trashName); err != nil && !quobyte_api.IsNotFound(err) {
+			driver.log.Error(err)
+			return volume.Response{Err: apiError("trash", "volume "+volumeName, err)}
+		}
+	default:
+		driver.log.Infof("Removing volume %s of tenant %s", volumeName, tenantID)
+		if err := driver.client.DeleteVolume(vol.VolumeUUID); err != nil {
+			// A volume which is already gone in Quobyte only needs to be forgotten by Docker
+			if !quobyte_api.IsNotFound(err) {
+				driver.log.Error(err)
+				return volume.Response{Err: apiError("remove", "volume "+volumeName, err)}
+			}
+			driver.log.Infof("Volume %s is already gone: %s", volumeName, err)
+		}
+	}
+
+	if err := driver.state.forget(request.Name); err != nil {
+		driver.log.Errorf("Unable to persist mount state: %s", err)
+	}
 
 	return volume.Response{Err: ""}
 }
 
+// mountVolume mounts the Quobyte volume of a Docker volume with the FUSE options recorded for it
+func (driver quobyteDriver) mountVolume(name, volumeName string) error {
+	record, _ := driver.state.volume(name)
+	if err := checkFuseOptions(record.MountOptions); err != nil {
+		return fmt.Errorf("Unable to mount volume %s: %s", name, err)
+	}
+	return driver.mounter.mount(volumeName, record.MountOptions)
+}
+
+// mountReadOnly bind mounts the Docker volume read-only at its readOnlyPath
+func (driver quobyteDriver) mountReadOnly(name string) error {
+	target := driver.readOnlyPath(name)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	driver.log.Infof("Bind mounting volume %s read-only on %s", name, target)
+	return bindMount(driver.mountPoint(name), target, true)
+}
+
+// releaseReadOnlyMount removes the read-only bind mount of the Docker volume if there is one
+func (driver quobyteDriver) releaseReadOnlyMount(name string) {
+	target := driver.readOnlyPath(name)
+	if driver.readOnlyMount == "" || !isMounted(target) {
+		return
+	}
+	if err := unmount(target, false); err != nil {
+		driver.log.Errorf("Unable to unmount read-only mount of volume %s: %s", name, err)
+		return
+	}
+	if err := os.Remove(target); err != nil {
+		driver.log.Warn(err)
+	}
+}
+
+// releaseVolumeMount unmounts a volume mounted on its own once no container uses it anymore
+func (driver quobyteDriver) releaseVolumeMount(volumeName string) {
+	if driver.mounter == nil || len(driver.state.containers(volumeName)) > 0 {
+		return
+	}
+	if err := driver.mounter.unmount(volumeName); err != nil {
+		driver.log.Errorf("Unable to unmount volume %s: %s", volumeName, err)
+	}
+}
+
+// removeSubdir applies the deletion policy to the subtree of a subdirectory volume
+func (driver quobyteDriver) removeSubdir(name string, policy string) error {
+	mPoint := driver.mountPoint(name)
+	switch policy {
+	case deletionPolicyTrash:
+		trashPath := filepath.Join(filepath.Dir(mPoint), fmt.Sprintf("%s%d-%s", trashPrefix, time.Now().Unix(), filepath.Base(mPoint)))
+		driver.log.Infof("Moving subdirectory %s to trash as %s", mPoint, trashPath)
+		return os.Rename(mPoint, trashPath)
+	default:
+		driver.log.Infof("Removing subdirectory %s", mPoint)
+		return os.RemoveAll(mPoint)
+	}
+}
+
 func (driver quobyteDriver) Mount(request volume.MountRequest) volume.Response {
-	driver.m.Lock()
-	defer driver.m.Unlock()
-	volumeName, _ := driver.stripVolumeName(request.Name)
-	mPoint := filepath.Join(driver.quobyteMount, volumeName)
-	log.Printf("Mounting volume %s on %s\n", volumeName, mPoint)
+	driver = driver.withRequest("Mount", request.Name)
+	driver.log = driver.log.WithField("container_id", request.ID)
+	volumeName, _, err := driver.stripVolumeName(request.Name)
+	if err != nil {
+		driver.log.Warn(err)
+		return volume.Response{Err: err.Error()}
+	}
+	defer driver.locks.lock(volumeName)()
+
+	if err := driver.watchdog.err(); err != nil {
+		driver.log.Errorf("Refusing to mount volume %s, the Quobyte namespace is unhealthy: %s", request.Name, err)
+		return volume.Response{Err: fmt.Sprintf("Quobyte namespace at %s is unhealthy: %s", driver.quobyteMount, err)}
+	}
+
+	if _, known := driver.state.volume(request.Name); !known {
+		// Volumes created on another host or before a reboot are not in the state file, their
+		// settings like readonly are only kept in the label of the Quobyte volume
+		vol, err := driver.client.GetVolume(volumeName, driver.tenantOf(request.Name))
+		if err != nil && !quobyte_api.IsNotFound(err) {
+			driver.log.Error(err)
+			return volume.Response{Err: apiError("read the settings of", "volume "+request.Name, err)}
+		}
+		driver.recordOf(request.Name, vol)
+	}
+
+	mPoint := driver.containerPath(request.Name)
+	driver.log.Infof("Mounting volume %s on %s for container %s", request.Name, mPoint, request.ID)
+	if driver.mounter != nil {
+		if err := driver.mountVolume(request.Name, volumeName); err != nil {
+			driver.log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+	}
+	if err := driver.checkSubdirPath(request.Name); err != nil {
+		driver.log.Error(err)
+		driver.releaseVolumeMount(volumeName)
+		return volume.Response{Err: err.Error()}
+	}
+	if mPoint != driver.mountPoint(request.Name) && !isMounted(mPoint) {
+		if err := driver.mountReadOnly(request.Name); err != nil {
+			driver.log.Error(err)
+			driver.releaseVolumeMount(volumeName)
+			return volume.Response{Err: fmt.Sprintf("Unable to mount volume %s read-only: %s", request.Name, err)}
+		}
+	}
+
+	count, err := driver.state.add(request.Name, request.ID)
+	if err != nil {
+		driver.log.Errorf("Unable to persist mount state: %s", err)
+	}
+	driver.log.Infof("Volume %s has %d active mount(s)", request.Name, count)
 	return volume.Response{Err: "", Mountpoint: mPoint}
 }
 
 func (driver quobyteDriver) Path(request volume.Request) volume.Response {
-	volumeName, _ := driver.stripVolumeName(request.Name)
-	return volume.Response{Mountpoint: filepath.Join(driver.quobyteMount, volumeName)}
+	if err := driver.checkSubdirPath(request.Name); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	return volume.Response{Mountpoint: driver.containerPath(request.Name)}
 }
 
 func (driver quobyteDriver) Unmount(request volume.UnmountRequest) volume.Response {
+	driver = driver.withRequest("Unmount", request.Name)
+	driver.log = driver.log.WithField("container_id", request.ID)
+	volumeName, _, err := driver.stripVolumeName(request.Name)
+	if err != nil {
+		driver.log.Warn(err)
+		return volume.Response{Err: err.Error()}
+	}
+	defer driver.locks.lock(volumeName)()
+
+	count, err := driver.state.remove(request.Name, request.ID)
+	if err != nil {
+		driver.log.Errorf("Unable to persist mount state: %s", err)
+	}
+	driver.log.Infof("Unmounted volume %s for container %s, %d active mount(s) left", request.Name, request.ID, count)
+	if count == 0 {
+		driver.releaseReadOnlyMount(request.Name)
+	}
+	driver.releaseVolumeMount(volumeName)
 	return volume.Response{}
 }
 
 func (driver quobyteDriver) Get(request volume.Request) volume.Response {
-	driver.m.Lock()
-	defer driver.m.Unlock()
+	driver = driver.withRequest("Get", request.Name)
+	volumeName, subDirs, err := driver.stripVolumeName(request.Name)
+	if err != nil {
+		driver.log.Warn(err)
+		return volume.Response{Err: err.Error()}
+	}
+	defer driver.locks.lock(volumeName)()
+
+	tenantID := driver.tenantOf(request.Name)
+	driver.log = driver.log.WithField("tenant", tenantID)
+	vol, err := driver.client.GetVolume(volumeName, tenantID)
+	if quobyte_api.IsNotFound(err) {
+		driver.log.Warn(err)
+		return volume.Response{Err: fmt.Sprintf("volume %s not found in tenant %s", volumeName, tenantID)}
+	}
+	record, _ := driver.state.volume(request.Name)
+	if err == nil {
+		record, _ = driver.recordOf(request.Name, vol)
+	}
+	if record.Retained {
+		return volume.Response{Err: fmt.Sprintf("volume %s was removed from Docker and is only retained in Quobyte", request.Name)}
+	}
+	if err != nil {
+		// Docker gets the volume before every container start, an unreachable API must not
+		// block them. Mount still refuses volumes whose settings are unknown on this host.
+		driver.log.Warnf("Unable to get volume %s, returning it without status: %s", volumeName, err)
+		return volume.Response{Volume: &volume.Volume{Name: request.Name, Mountpoint: driver.containerPath(request.Name)}}
+	}
 
-	volumeName, _ := driver.stripVolumeName(request.Name)
-	mPoint := filepath.Join(driver.quobyteMount, volumeName)
+	mPoint := driver.mountPoint(request.Name)
+	// With per volume mounts the subdirectory can only be checked while the volume is mounted
+	if subDirs != "" && (driver.mounter == nil || isMounted(driver.mounter.path(volumeName))) {
+		if fi, err := os.Stat(mPoint); err != nil || !fi.IsDir() {
+			driver.log.Warnf("Subdirectory %s is missing or not a directory: %v", mPoint, err)
+			return volume.Response{Err: fmt.Sprintf("subdirectory %s of volume %s does not exist", subDirs, volumeName)}
+		}
+	}
 
-	if fi, err := os.Lstat(mPoint); err != nil || !fi.IsDir() {
-		log.Println(err)
-		return volume.Response{Err: fmt.Sprintf("%v not mounted", mPoint)}
+	quotas, err := driver.client.GetVolumeQuota(vol.VolumeUUID)
+	if err != nil {
+		driver.log.Warnf("Unable to get quota of volume %s: %s", volumeName, err)
 	}
 
-	return volume.Response{Volume: &volume.Volume{Name: request.Name, Mountpoint: mPoint}}
+	status := driver.volumeStatus(request.Name, vol, driver.mountingClients(tenantID), quotas)
+	return volume.Response{Volume: &volume.Volume{Name: request.Name, Mountpoint: driver.containerPath(request.Name), Status: status}}
 }
 
 func (driver quobyteDriver) List(request volume.Request) volume.Response {
-	driver.m.Lock()
-	defer driver.m.Unlock()
+	driver = driver.withRequest("List", "")
+	// Volumes of other tenants are only listed if they were created through this plugin,
+	// subdirectory volumes are listed together with the Quobyte volume they live in
+	foreign := make(map[string]map[string]bool)
+	subdirs := make(map[string][]string)
+	retained := make(map[string]bool)
+	for name, record := range driver.state.volumes() {
+		tenantID := record.TenantID
+		if tenantID == "" {
+			tenantID = driver.tenantID
+		}
+		volumeName, subDirs, err := driver.stripVolumeName(name)
+		if err != nil {
+			driver.log.Warnf("Skipping volume of the state file: %s", err)
+			continue
+		}
+		if record.Retained {
+			retained[tenantID+"/"+name] = true
+			continue
+		}
+		if tenantID != driver.tenantID {
+			if _, ok := foreign[tenantID]; !ok {
+				foreign[tenantID] = make(map[string]bool)
+			}
+			if subDirs == "" {
+				foreign[tenantID][volumeName] = true
+			}
+		}
+		if subDirs != "" {
+			key := tenantID + "/" + volumeName
+			subdirs[key] = append(subdirs[key], name)
+		}
+	}
 
 	var vols []*volume.Volume
-	files, err := ioutil.ReadDir(driver.quobyteMount)
-	if err != nil {
-		log.Println(err)
-		return volume.Response{Err: err.Error()}
+	addVolumes := func(tenantID string, include func(string) bool) error {
+		response, err := driver.client.GetVolumeList(tenantID)
+		if err != nil {
+			return err
+		}
+		clients := driver.mountingClients(tenantID)
+		for _, vol := range response.Volumes {
+			if strings.HasPrefix(vol.Name, trashPrefix) {
+				continue
+			}
+			// The labels of the volume are kept on all hosts, the state file only knows the
+			// volumes created on this host
+			isRetained := func(name, subDirs string) bool {
+				if record, ok := labelRecord(vol.Labels, subDirs); ok {
+					return record.Retained
+				}
+				return retained[tenantID+"/"+name]
+			}
+			if include(vol.Name) && !isRetained(vol.Name, "") {
+				vols = append(vols, &volume.Volume{Name: vol.Name, Mountpoint: driver.containerPath(vol.Name), Status: driver.volumeStatus(vol.Name, vol, clients, nil)})
+			}
+
+			names := make(map[string]bool)
+			for _, name := range subdirs[tenantID+"/"+vol.Name] {
+				names[name] = true
+			}
+			for _, label := range vol.Labels {
+				if strings.HasPrefix(label.Name, recordLabel+":") {
+					names[vol.Name+"/"+strings.TrimPrefix(label.Name, recordLabel+":")] = true
+				}
+			}
+			var sorted []string
+			for name := range names {
+				if _, subDirs, err := driver.stripVolumeName(name); err == nil && !isRetained(name, subDirs) {
+					sorted = append(sorted, name)
+				}
+			}
+			sort.Strings(sorted)
+			for _, name := range sorted {
+				vols = append(vols, &volume.Volume{Name: name, Mountpoint: driver.containerPath(name), Status: driver.volumeStatus(name, vol, clients, nil)})
+			}
+		}
+		return nil
 	}
 
-	for _, entry := range files {
-		if entry.IsDir() {
-			volumeName, _ := driver.stripVolumeName(entry.Name())
-			vols = append(vols, &volume.Volume{Name: entry.Name(), Mountpoint: filepath.Join(driver.quobyteMount, volumeName)})
+	if err := addVolumes(driver.tenantID, func(string) bool { return true }); err != nil {
+		driver.log.WithField("tenant", driver.tenantID).Error(err)
+		return volume.Response{Err: apiError("list", "volumes of tenant "+driver.tenantID, err)}
+	}
+	for tenantID, names := range foreign {
+		if err := addVolumes(tenantID, func(name string) bool { return names[name] }); err != nil {
+			driver.log.WithField("tenant", tenantID).Warnf("Unable to list volumes of tenant %s: %s", tenantID, err)
 		}
 	}
 
 	return volume.Response{Volumes: vols}
 }
 
+// mountingClients returns the number of clients mounting each volume of the tenant, keyed by volume UUID
+func (driver quobyteDriver) mountingClients(tenantID string) map[string]int {
+	response, err := driver.client.GetClientList(tenantID)
+	if err != nil {
+		driver.log.Warnf("Unable to get client list of tenant %s: %s", tenantID, err)
+		return nil
+	}
+
+	clients := make(map[string]int)
+	for _, client := range response.Clients {
+		clients[client.MountedVolumeUUID]++
+	}
+	return clients
+}
+
+// volumeStatus builds the Status shown by docker volume inspect from the plugins state and the Quobyte metadata
+func (driver quobyteDriver) volumeStatus(name string, vol quobyte_api.Volume, clients map[string]int, quotas []quobyte_api.Quota) map[string]interface{} {
+	status := map[string]interface{}{"active_mounts": driver.state.count(name)}
+	if _, subDirs, _ := driver.stripVolumeName(name); subDirs != "" {
+		status["subdirectory"] = subDirs
+	}
+	if vol.VolumeUUID == "" {
+		return status
+	}
+
+	status["uuid"] = vol.VolumeUUID
+	status["tenant"] = vol.TenantDomain
+	status["configuration_name"] = vol.ConfigurationName
+	status["root_user"] = vol.RootUserID
+	status["root_group"] = vol.RootGroupID
+	status["used_bytes"] = vol.UsedLogicalSpace
+	status["file_count"] = vol.FileCount
+	if vol.CreationTimestampMs > 0 {
+		status["created"] = time.Unix(0, vol.CreationTimestampMs*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+	}
+	if clients != nil {
+		status["clients"] = clients[vol.VolumeUUID]
+	}
+	for _, quota := range quotas {
+		for _, limit := range quota.Limits {
+			switch limit.Type {
+			case quobyte_api.QuotaResourceLogicalDiskSpace:
+				status["quota_bytes"] = limit.Value
+			case quobyte_api.QuotaResourceFileCount:
+				status["quota_files"] = limit.Value
+			}
+		}
+	}
+	return status
+}
+
 func (driver quobyteDriver) Capabilities(request volume.Request) volume.Response {
 	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
 }
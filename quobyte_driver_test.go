@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	quobyte_api "github.com/quobyte/api"
+)
+
+// fakeAPI answers JSON-RPC requests with the result configured for their method and
+// ENTITY_NOT_FOUND for all other methods. It records the called methods and the last
+// parameters of each method. Labels set on volumes are kept and returned with the volumes
+// of getVolumeList.
+type fakeAPI struct {
+	m       *sync.Mutex
+	results map[string]string
+	calls   []string
+	params  map[string]string
+	// labels maps a volume UUID to its labels
+	labels map[string]map[string]string
+}
+
+type fakeLabels struct {
+	Labels []struct {
+		EntityID string `json:"entity_id"`
+		Name     string `json:"name"`
+		Value    string `json:"value"`
+	} `json:"label"`
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	api.m.Lock()
+	defer api.m.Unlock()
+	api.calls = append(api.calls, req.Method)
+	api.params[req.Method] = string(req.Params)
+	switch req.Method {
+	case "setLabels", "deleteLabels":
+		var labels fakeLabels
+		json.Unmarshal(req.Params, &labels)
+		for _, label := range labels.Labels {
+			if _, ok := api.labels[label.EntityID]; !ok {
+				api.labels[label.EntityID] = make(map[string]string)
+			}
+			if req.Method == "setLabels" {
+				api.labels[label.EntityID][label.Name] = label.Value
+			} else {
+				delete(api.labels[label.EntityID], label.Name)
+			}
+		}
+		fmt.Fprint(w, `{"id":"0","jsonrpc":"2.0","result":{}}`)
+		return
+	}
+	if _, ok := api.results[req.Method]; !ok && req.Method == "resolveVolumeName" {
+		fmt.Fprint(w, api.resolve(req.Params))
+		return
+	}
+	if result, ok := api.results[req.Method]; ok {
+		if req.Method == "getVolumeList" {
+			result = api.withLabels(result)
+		}
+		fmt.Fprintf(w, `{"id":"0","jsonrpc":"2.0","result":%s}`, result)
+		return
+	}
+	fmt.Fprint(w, `{"id":"0","jsonrpc":"2.0","error":{"code":-32000,"message":"ENTITY_NOT_FOUND/POSIX_ERROR_NONE"}}`)
+}
+
+// resolve answers resolveVolumeName with the UUID of the volume of the same name in the
+// getVolumeList result
+func (api *fakeAPI) resolve(params json.RawMessage) string {
+	var request struct {
+		VolumeName string `json:"volume_name"`
+	}
+	var list struct {
+		Volumes []struct {
+			UUID string `json:"volume_uuid"`
+			Name string `json:"name"`
+		} `json:"volume"`
+	}
+	json.Unmarshal(params, &request)
+	json.Unmarshal([]byte(api.results["getVolumeList"]), &list)
+	for _, vol := range list.Volumes {
+		if vol.Name == request.VolumeName {
+			return fmt.Sprintf(`{"id":"0","jsonrpc":"2.0","result":{"volume_uuid":"%s"}}`, vol.UUID)
+		}
+	}
+	return `{"id":"0","jsonrpc":"2.0","error":{"code":-32000,"message":"ENTITY_NOT_FOUND/POSIX_ERROR_NONE"}}`
+}
+
+// withLabels adds the labels of the volumes to a getVolumeList result
+func (api *fakeAPI) withLabels(result string) string {
+	var list struct {
+		Volumes []map[string]interface{} `json:"volume"`
+	}
+	if err := json.Unmarshal([]byte(result), &list); err != nil {
+		return result
+	}
+	for _, vol := range list.Volumes {
+		var labels []map[string]string
+		for name, value := range api.labels[fmt.Sprint(vol["volume_uuid"])] {
+			labels = append(labels, map[string]string{"name": name, "value": value})
+		}
+		vol["label"] = labels
+	}
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+func (api *fakeAPI) paramsOf(method string) string {
+	api.m.Lock()
+	defer api.m.Unlock()
+	return api.params[method]
+}
+
+func (api *fakeAPI) called() []string {
+	api.m.Lock()
+	defer api.m.Unlock()
+	return append([]string(nil), api.calls...)
+}
+
+// newTestDriver returns a driver using a temporary directory as Quobyte mount and api as
+// API server. The returned function removes the directory and stops the server.
+func newTestDriver(t *testing.T, api *fakeAPI) (quobyteDriver, func()) {
+	dir, err := ioutil.TempDir("", "quobyte-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(api)
+	mountPath := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mountPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := loadPluginState(filepath.Join(dir, "state.json"))
+	driver := newQuobyteDriver(server.URL, "user", "password", mountPath, 1, 1, "BASE", "tenant", deletionPolicyDelete, state)
+	driver.client.SetRetries(0)
+	return driver, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newFakeAPI(results map[string]string) *fakeAPI {
+	return &fakeAPI{m: &sync.Mutex{}, results: results, params: make(map[string]string), labels: make(map[string]map[string]string)}
+}
+
+func TestStripVolumeName(t *testing.T) {
+	driver := quobyteDriver{quobyteMount: "/mnt"}
+	expectedResults := map[string][2]string{
+		"vol":          {"vol", ""},
+		"vol/":         {"vol", ""},
+		"vol/a/b":      {"vol", "a/b"},
+		"vol/a/../b":   {"vol", "b"},
+		"vol/a/..":     {"vol", ""},
+		"vol/..":       {"", ""},
+		"vol/../other": {"", ""},
+		"vol/a/../..":  {"", ""},
+		"vol//etc":     {"", ""},
+		"..":           {"", ""},
+		"../vol":       {"", ""},
+		"":             {"", ""},
+	}
+
+	for name, res := range expectedResults {
+		volumeName, subDirs, err := driver.stripVolumeName(name)
+		if volumeName != res[0] || subDirs != res[1] || (err == nil) != (res[0] != "") {
+			log.Printf("Got:\n%s %s %v\nExpected:\n%s %s\nName:\n%s\n", volumeName, subDirs, err, res[0], res[1], name)
+			t.FailNow()
+		}
+	}
+}
+
+func TestSubdirectoryTraversal(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"resolveVolumeName": `{"volume_uuid":"1234"}`,
+		"getVolumeList":     `{"volume":[{"volume_uuid":"1234","name":"vol"}]}`,
+		"deleteVolume":      `{}`,
+	})
+	driver, cleanup := newTestDriver(t, api)
+	defer cleanup()
+
+	other := filepath.Join(driver.quobyteMount, "other")
+	if err := os.MkdirAll(filepath.Join(driver.quobyteMount, "vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"vol/..", "vol/../other"} {
+		if response := driver.Get(volume.Request{Name: name}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+		if response := driver.Mount(volume.MountRequest{Name: name, ID: "container"}); response.Err == "" || response.Mountpoint != "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+		if response := driver.Path(volume.Request{Name: name}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+		if response := driver.Remove(volume.Request{Name: name}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		log.Printf("Got:\n%v\nExpected:\n%s to be kept\n", err, other)
+		t.FailNow()
+	}
+	if calls := api.called(); len(calls) != 0 {
+		log.Printf("Got:\n%v\nExpected:\nno API calls\n", calls)
+		t.FailNow()
+	}
+	if count := driver.state.count("vol/../other"); count != 0 {
+		log.Printf("Got:\n%d\nExpected:\n%d\n", count, 0)
+		t.FailNow()
+	}
+}
+
+func TestSubdirectorySymlinks(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"createVolume":  `{"volume_uuid":"1234"}`,
+		"getVolumeList": `{"volume":[{"volume_uuid":"1234","name":"vol"}]}`,
+	})
+	names := []string{"vol/x", "vol/x/keep", "vol/x/new", "vol/dangling/new"}
+	api.labels["1234"] = make(map[string]string)
+	for _, name := range names {
+		// Without the delete policy Remove would only mark the volumes as retained
+		api.labels["1234"][recordLabelName(name[len("vol/"):])] = `{"created_by_plugin":true,"deletion_policy":"delete"}`
+	}
+	driver, cleanup := newTestDriver(t, api)
+	defer cleanup()
+
+	outside, err := ioutil.TempDir("", "quobyte-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	volumePath := filepath.Join(driver.quobyteMount, "vol")
+	for _, dir := range []string{filepath.Join(outside, "keep"), filepath.Join(volumePath, "real")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"x": outside, "dangling": filepath.Join(outside, "missing"), "inside": "real"} {
+		if err := os.Symlink(target, filepath.Join(volumePath, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range names {
+		if response := driver.Create(volume.Request{Name: name}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+		if response := driver.Mount(volume.MountRequest{Name: name, ID: "container"}); response.Err == "" || response.Mountpoint != "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+		if response := driver.Path(volume.Request{Name: name}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+		if response := driver.Remove(volume.Request{Name: name}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for %s\n", response, name)
+			t.FailNow()
+		}
+	}
+	for _, path := range []string{filepath.Join(outside, "keep"), filepath.Join(outside, "new"), filepath.Join(outside, "missing")} {
+		if _, err := os.Stat(path); (err == nil) != (path == filepath.Join(outside, "keep")) {
+			log.Printf("Got:\n%v\nExpected:\nonly %s outside of the volume\n", err, filepath.Join(outside, "keep"))
+			t.FailNow()
+		}
+	}
+
+	// Symlinks which stay inside the volume are fine
+	if response := driver.Path(volume.Request{Name: "vol/inside/sub"}); response.Err != "" {
+		log.Printf("Got:\n%s\nExpected:\nno error\n", response.Err)
+		t.FailNow()
+	}
+}
+
+func TestRemoveRetainedTwice(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"getVolumeList": `{"volume":[{"volume_uuid":"1234","name":"vol"},{"volume_uuid":"5678","name":"other"}]}`,
+		"deleteVolume":  `{}`,
+	})
+	api.labels["1234"] = map[string]string{recordLabel: `{"created_by_plugin":true,"tenant_id":"tenant","deletion_policy":"retain"}`}
+	driver, cleanup := newTestDriver(t, api)
+	defer cleanup()
+
+	// other has no record, so its deletion policy is unknown and it is retained as well
+	for _, name := range []string{"vol", "other"} {
+		if response := driver.Remove(volume.Request{Name: name}); response.Err != "" {
+			log.Printf("Got:\n%s\nExpected:\nno error\n", response.Err)
+			t.FailNow()
+		}
+	}
+
+	// The retained volumes stay hidden and retained on other hosts, which have no state of them
+	otherHost, cleanupOtherHost := newTestDriver(t, api)
+	defer cleanupOtherHost()
+	for _, driver := range []quobyteDriver{driver, otherHost} {
+		if response := driver.List(volume.Request{}); len(response.Volumes) != 0 {
+			log.Printf("Got:\n%v\nExpected:\nno volumes\n", response.Volumes)
+			t.FailNow()
+		}
+		if response := driver.Get(volume.Request{Name: "vol"}); response.Err == "" {
+			log.Printf("Got:\n%v\nExpected:\nan error for a retained volume\n", response.Volume)
+			t.FailNow()
+		}
+		for _, name := range []string{"vol", "other"} {
+			if response := driver.Remove(volume.Request{Name: name}); response.Err != "" {
+				log.Printf("Got:\n%s\nExpected:\nno error\n", response.Err)
+				t.FailNow()
+			}
+		}
+	}
+
+	for _, call := range api.called() {
+		if call == "deleteVolume" {
+			log.Printf("Got:\n%v\nExpected:\nno deleteVolume call\n", api.called())
+			t.FailNow()
+		}
+	}
+	if record, _ := otherHost.state.volume("other"); !record.Retained || record.DeletionPolicy != deletionPolicyRetain {
+		log.Printf("Got:\n%v\nExpected:\na retained record\n", record)
+		t.FailNow()
+	}
+}
+
+func TestRemoveStaleMounts(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"getVolumeList": `{"volume":[{"volume_uuid":"1234","name":"vol"}]}`,
+		"deleteVolume":  `{}`,
+	})
+	api.labels["1234"] = map[string]string{recordLabel: `{"created_by_plugin":true,"tenant_id":"tenant"}`}
+	driver, cleanup := newTestDriver(t, api)
+	defer cleanup()
+	mounter := &fakeMounter{base: driver.quobyteMount, mounted: make(map[string]bool)}
+	driver.mounter = mounter
+
+	// container-1 died without an Unmount, Docker only calls Remove once it is gone.
+	// The subdirectory volume vol/sub is a separate Docker volume which is still in use.
+	driver.state.add("vol", "container-1")
+	if response := driver.Mount(volume.MountRequest{Name: "vol/sub", ID: "container-2"}); response.Err != "" {
+		t.Fatal(response.Err)
+	}
+	driver.state.add("other", "container-3")
+
+	before := len(api.called())
+	if response := driver.Remove(volume.Request{Name: "vol"}); response.Err == "" {
+		log.Printf("Got:\nno error\nExpected:\nan error while vol/sub is in use\n")
+		t.FailNow()
+	}
+	if calls := api.called()[before:]; len(calls) != 0 || len(mounter.unmounts) != 0 {
+		log.Printf("Got:\n%v %v\nExpected:\nno API calls and unmounts\n", calls, mounter.unmounts)
+		t.FailNow()
+	}
+	if got := driver.state.containers("vol"); !reflect.DeepEqual(got, []string{"container-2"}) {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", got, []string{"container-2"})
+		t.FailNow()
+	}
+
+	driver.Unmount(volume.UnmountRequest{Name: "vol/sub", ID: "container-2"})
+	if response := driver.Remove(volume.Request{Name: "vol"}); response.Err != "" {
+		log.Printf("Got:\n%s\nExpected:\nno error\n", response.Err)
+		t.FailNow()
+	}
+	if calls := api.called(); len(calls) == 0 || calls[len(calls)-1] != "deleteVolume" {
+		log.Printf("Got:\n%v\nExpected:\na deleteVolume call\n", calls)
+		t.FailNow()
+	}
+
+	loaded, err := loadPluginState(driver.state.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.containers("vol"); len(got) != 0 {
+		log.Printf("Got:\n%v\nExpected:\nno containers\n", got)
+		t.FailNow()
+	}
+	if got := loaded.count("other"); got != 1 {
+		log.Printf("Got:\n%d\nExpected:\n%d\n", got, 1)
+		t.FailNow()
+	}
+}
+
+func TestCreateSubdirectoryQuota(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"createVolume":      `{"volume_uuid":"1234"}`,
+		"resolveVolumeName": `{"volume_uuid":"1234"}`,
+		"setQuota":          `{}`,
+	})
+	driver, cleanup := newTestDriver(t, api)
+	defer cleanup()
+	driver.tenantDefaults = map[string]map[string]string{"tenant": {"size": "1GiB", "max_files": "1000"}}
+	if err := os.MkdirAll(filepath.Join(driver.quobyteMount, "shared"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, option := range []string{"size", "quota", "max_files"} {
+		request := volume.Request{Name: "shared/teamA", Options: map[string]string{option: "1000"}}
+		if response := driver.Create(request); response.Err == "" {
+			log.Printf("Got:\nno error\nExpected:\nan error for option %s\n", option)
+			t.FailNow()
+		}
+	}
+	if calls := api.called(); len(calls) != 0 {
+		log.Printf("Got:\n%v\nExpected:\nno API calls\n", calls)
+		t.FailNow()
+	}
+
+	// The quota defaults of the tenant only apply to whole Quobyte volumes
+	if response := driver.Create(volume.Request{Name: "shared/teamA"}); response.Err != "" {
+		log.Printf("Got:\n%s\nExpected:\nno error\n", response.Err)
+		t.FailNow()
+	}
+	for _, call := range api.called() {
+		if call == "setQuota" {
+			log.Printf("Got:\n%v\nExpected:\nno setQuota call\n", api.called())
+			t.FailNow()
+		}
+	}
+}
+
+func TestSettingsOnOtherHosts(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"createVolume":  `{"volume_uuid":"1234"}`,
+		"getVolumeList": `{"volume":[{"volume_uuid":"1234","name":"vol"}]}`,
+		"getQuota":      `{}`,
+	})
+	driver, cleanup := newTestDriver(t, api)
+	defer cleanup()
+	driver.readOnlyMount = filepath.Join(driver.quobyteMount, "readonly")
+	if response := driver.Create(volume.Request{Name: "vol", Options: map[string]string{"readonly": "true"}}); response.Err != "" {
+		t.Fatal(response.Err)
+	}
+
+	otherHost, cleanupOtherHost := newTestDriver(t, api)
+	defer cleanupOtherHost()
+	otherHost.readOnlyMount = driver.readOnlyMount
+	if response := otherHost.Get(volume.Request{Name: "vol"}); response.Err != "" || response.Volume.Mountpoint != otherHost.readOnlyPath("vol") {
+		log.Printf("Got:\n%v %v\nExpected:\n%s\n", response.Err, response.Volume, otherHost.readOnlyPath("vol"))
+		t.FailNow()
+	}
+	if response := otherHost.Path(volume.Request{Name: "vol"}); response.Mountpoint != otherHost.readOnlyPath("vol") {
+		log.Printf("Got:\n%s\nExpected:\n%s\n", response.Mountpoint, otherHost.readOnlyPath("vol"))
+		t.FailNow()
+	}
+
+	// Without the label the settings are unknown, so the volume is not mounted read-write
+	unreachable, cleanupUnreachable := newTestDriver(t, api)
+	defer cleanupUnreachable()
+	unreachable.client = quobyte_api.NewQuobyteClient("http://127.0.0.1:1", "user", "password")
+	unreachable.client.SetRetries(0)
+	if response := unreachable.Mount(volume.MountRequest{Name: "vol", ID: "container"}); response.Err == "" || response.Mountpoint != "" {
+		log.Printf("Got:\n%v\nExpected:\nan error\n", response)
+		t.FailNow()
+	}
+}
+
+func TestGetWithoutAPI(t *testing.T) {
+	driver, cleanup := newTestDriver(t, newFakeAPI(map[string]string{}))
+	defer cleanup()
+	driver.client = quobyte_api.NewQuobyteClient("http://127.0.0.1:1", "user", "password")
+	driver.client.SetRetries(0)
+	if err := driver.state.setVolume("vol", volumeRecord{CreatedByPlugin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.state.setVolume("old", volumeRecord{Retained: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Container starts go on with the mountpoint, the status needs the API
+	response := driver.Get(volume.Request{Name: "vol"})
+	if response.Err != "" || response.Volume == nil || response.Volume.Mountpoint != driver.mountPoint("vol") || response.Volume.Status != nil {
+		log.Printf("Got:\n%v %v\nExpected:\n%s without status\n", response.Err, response.Volume, driver.mountPoint("vol"))
+		t.FailNow()
+	}
+	if response := driver.Get(volume.Request{Name: "old"}); response.Err == "" {
+		log.Printf("Got:\n%v\nExpected:\nan error for the retained volume\n", response.Volume)
+		t.FailNow()
+	}
+}
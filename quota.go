@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	quobyte_api "github.com/quobyte/api"
+)
+
+// quotaOptions are the create options accepted by -set-quota
+var quotaOptions = map[string]bool{
+	"size":      true,
+	"quota":     true,
+	"max_files": true,
+	"tenant_id": true,
+}
+
+// setQuota changes the quota of the Quobyte volume volumeName, e.g. to grow a quota set with
+// the size create option. Docker does not call Create for volumes it knows, so the create
+// options can not change the quota of an existing volume. The args are create options like
+// size=20GiB or max_files=100000, limits which are not given are kept.
+func setQuota(client *quobyte_api.QuobyteClient, tenantID, volumeName string, args []string) error {
+	if volumeName == "" || volumeName == "." || volumeName == ".." || strings.Contains(volumeName, "/") {
+		return fmt.Errorf("Invalid volume name %q, quotas are set on whole Quobyte volumes", volumeName)
+	}
+
+	options := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || !quotaOptions[parts[0]] {
+			return fmt.Errorf("Invalid quota option %q, expected size=<size>, max_files=<count> or tenant_id=<tenant>", arg)
+		}
+		options[parts[0]] = parts[1]
+	}
+	opts, err := parseVolumeOptions(options, volumeOptions{tenantID: tenantID})
+	if err != nil {
+		return err
+	}
+	if opts.quotaBytes == 0 && opts.quotaFiles == 0 {
+		return fmt.Errorf("No quota given, expected size=<size> and/or max_files=<count>")
+	}
+
+	volumeUUID, err := client.ResolveVolumeNameToUUID(volumeName, opts.tenantID)
+	if err != nil {
+		return err
+	}
+	quotas, err := client.GetVolumeQuota(volumeUUID)
+	if err != nil {
+		return err
+	}
+	for _, quota := range quotas {
+		for _, limit := range quota.Limits {
+			switch {
+			case limit.Type == quobyte_api.QuotaResourceLogicalDiskSpace && opts.quotaBytes == 0:
+				opts.quotaBytes = limit.Value
+			case limit.Type == quobyte_api.QuotaResourceFileCount && opts.quotaFiles == 0:
+				opts.quotaFiles = limit.Value
+			}
+		}
+	}
+	return client.SetVolumeQuota(volumeUUID, opts.quotaBytes, opts.quotaFiles)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	quobyte_api "github.com/quobyte/api"
+)
+
+func TestSetQuota(t *testing.T) {
+	api := newFakeAPI(map[string]string{
+		"resolveVolumeName": `{"volume_uuid":"1234"}`,
+		"getQuota":          `{"quotas":[{"limits":[{"type":"LOGICAL_DISK_SPACE","value":"1024"},{"type":"FILE_COUNT","value":"100"}]}]}`,
+		"setQuota":          `{}`,
+	})
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := quobyte_api.NewQuobyteClient(server.URL, "user", "password")
+
+	expectedResults := []struct {
+		volume string
+		args   []string
+		err    error
+		params string
+	}{
+		{"vol", []string{"size=2KiB"}, nil,
+			`{"quotas":[{"consumer":[{"type":"VOLUME","identifier":"1234"}],"limits":[{"type":"LOGICAL_DISK_SPACE","value":"2048"},{"type":"FILE_COUNT","value":"100"}]}]}`},
+		{"vol", []string{"max_files=200", "tenant_id=other"}, nil,
+			`{"quotas":[{"consumer":[{"type":"VOLUME","identifier":"1234"}],"limits":[{"type":"LOGICAL_DISK_SPACE","value":"1024"},{"type":"FILE_COUNT","value":"200"}]}]}`},
+		{"vol", nil, fmt.Errorf("No quota given, expected size=<size> and/or max_files=<count>"), ""},
+		{"vol", []string{"user=root"}, fmt.Errorf(`Invalid quota option "user=root", expected size=<size>, max_files=<count> or tenant_id=<tenant>`), ""},
+		{"vol/sub", []string{"size=1G"}, fmt.Errorf(`Invalid volume name "vol/sub", quotas are set on whole Quobyte volumes`), ""},
+	}
+
+	for _, res := range expectedResults {
+		api.params = make(map[string]string)
+		err := setQuota(client, "tenant", res.volume, res.args)
+		if fmt.Sprint(err) != fmt.Sprint(res.err) || api.paramsOf("setQuota") != res.params {
+			log.Printf("Got:\n%v %s\nExpected:\n%v %s\n", err, api.paramsOf("setQuota"), res.err, res.params)
+			t.FailNow()
+		}
+	}
+	if params := api.paramsOf("resolveVolumeName"); params != "" {
+		log.Printf("Got:\n%s\nExpected:\nno request for invalid options\n", params)
+		t.FailNow()
+	}
+}
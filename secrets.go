@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	quobyte_api "github.com/quobyte/api"
+)
+
+const (
+	// defaultAPIPassword is the well known password of fresh Quobyte installations, it is
+	// refused unless explicitly allowed
+	defaultAPIPassword = "quobyte"
+	// secretPollInterval is how often the password file is checked for changes
+	secretPollInterval = 5 * time.Second
+)
+
+// readSecret reads a secret like a Docker secret from path, without trailing line breaks
+func readSecret(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(content), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("Secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// resolvePassword returns the content of passwordFile if it is set and password otherwise
+func resolvePassword(password, passwordFile string, allowDefault bool) (string, error) {
+	if passwordFile != "" {
+		var err error
+		if password, err = readSecret(passwordFile); err != nil {
+			return "", err
+		}
+	}
+	if password == defaultAPIPassword && !allowDefault {
+		return "", fmt.Errorf("Refusing to use the default API password, set QUOBYTE_API_PASSWORD_FILE " +
+			"or allow it with QUOBYTE_API_ALLOW_DEFAULT_PASSWORD=true for test setups")
+	}
+	return password, nil
+}
+
+// apiCredentials are the user and password of the API client. The password is read from
+// the password file if one is set, and changes of the file are passed to the client so
+// the password can be rotated without restarting the plugin.
+type apiCredentials struct {
+	m            *sync.Mutex
+	user         string
+	password     string
+	passwordFile string
+	allowDefault bool
+	// envPassword is used when no password is set on the command line or in the config file
+	envPassword string
+	// current is the password in use
+	current string
+	// failing is set while the password file can not be read, so the error is logged once
+	failing bool
+
+	client *quobyte_api.QuobyteClient
+}
+
+func newAPICredentials(user, password, passwordFile, envPassword string, allowDefault bool) (*apiCredentials, error) {
+	creds := &apiCredentials{m: &sync.Mutex{}, envPassword: envPassword, allowDefault: allowDefault}
+	if err := creds.update(user, password, passwordFile); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// get returns the user and the password in use
+func (creds *apiCredentials) get() (string, string) {
+	creds.m.Lock()
+	defer creds.m.Unlock()
+	return creds.user, creds.current
+}
+
+// update changes the credentials, e.g. after the config file was reloaded. Invalid
+// credentials are refused and the current ones are kept.
+func (creds *apiCredentials) update(user, password, passwordFile string) error {
+	creds.m.Lock()
+	defer creds.m.Unlock()
+
+	if password == "" {
+		password = creds.envPassword
+	}
+	current, err := resolvePassword(password, passwordFile, creds.allowDefault)
+	if err != nil {
+		return err
+	}
+	creds.user, creds.password, creds.passwordFile, creds.current = user, password, passwordFile, current
+	creds.failing = false
+	creds.apply()
+	return nil
+}
+
+// refresh re-reads the password file and passes a changed password to the client
+func (creds *apiCredentials) refresh() {
+	creds.m.Lock()
+	defer creds.m.Unlock()
+
+	if creds.passwordFile == "" {
+		return
+	}
+	current, err := resolvePassword("", creds.passwordFile, creds.allowDefault)
+	if err != nil {
+		if !creds.failing {
+			creds.log().Errorf("Unable to read the API password, keeping the current one: %s", err)
+		}
+		creds.failing = true
+		return
+	}
+	creds.failing = false
+	if current == creds.current {
+		return
+	}
+	creds.log().Infof("API password changed in %s", creds.passwordFile)
+	creds.current = current
+	creds.apply()
+}
+
+func (creds *apiCredentials) apply() {
+	if creds.client != nil {
+		creds.client.SetCredentials(creds.user, creds.current)
+	}
+}
+
+func (creds *apiCredentials) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"op": "credentials", "path": creds.passwordFile})
+}
+
+// run checks the password file for changes until stop is closed
+func (creds *apiCredentials) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(secretPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			creds.refresh()
+		}
+	}
+}
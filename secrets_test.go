@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quobyte-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretPath := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(secretPath, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyPath, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResults := []struct {
+		password     string
+		passwordFile string
+		allowDefault bool
+		expected     string
+		err          error
+	}{
+		{"secret", "", false, "secret", nil},
+		{"secret", secretPath, false, "from-file", nil},
+		{defaultAPIPassword, "", true, defaultAPIPassword, nil},
+		{defaultAPIPassword, "", false, "", fmt.Errorf("Refusing to use the default API password, set QUOBYTE_API_PASSWORD_FILE " +
+			"or allow it with QUOBYTE_API_ALLOW_DEFAULT_PASSWORD=true for test setups")},
+		{"secret", emptyPath, false, "", fmt.Errorf("Secret file %s is empty", emptyPath)},
+	}
+
+	for _, res := range expectedResults {
+		got, err := resolvePassword(res.password, res.passwordFile, res.allowDefault)
+		if got != res.expected || fmt.Sprint(err) != fmt.Sprint(res.err) {
+			log.Printf("Got:\n%s %v\nExpected:\n%s %v\n", got, err, res.expected, res.err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quobyte-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretPath := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(secretPath, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := newAPICredentials("admin", "", secretPath, defaultAPIPassword, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(secretPath, []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds.refresh()
+	if _, got := creds.get(); got != "rotated" {
+		log.Printf("Got:\n%s\nExpected:\n%s\n", got, "rotated")
+		t.FailNow()
+	}
+
+	// A removed file keeps the current password, falling back to the environment is refused
+	os.Remove(secretPath)
+	creds.refresh()
+	if _, got := creds.get(); got != "rotated" {
+		log.Printf("Got:\n%s\nExpected:\n%s\n", got, "rotated")
+		t.FailNow()
+	}
+	if err := creds.update("admin", "", ""); err == nil {
+		log.Printf("Got:\n%v\nExpected:\n%s\n", err, "refused default password")
+		t.FailNow()
+	}
+	if user, got := creds.get(); user != "admin" || got != "rotated" {
+		log.Printf("Got:\n%s %s\nExpected:\n%s %s\n", user, got, "admin", "rotated")
+		t.FailNow()
+	}
+}
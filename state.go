@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// volumeRecord holds what the plugin knows about a Docker volume from the time it was created
+type volumeRecord struct {
+	CreatedByPlugin bool   `json:"created_by_plugin"`
+	TenantID        string `json:"tenant_id,omitempty"`
+	DeletionPolicy  string `json:"deletion_policy,omitempty"`
+	MountOptions    string `json:"mount_options,omitempty"`
+	ReadOnly        bool   `json:"read_only,omitempty"`
+	// Retained is set when the volume was removed from Docker with the retain policy. The
+	// record hides it from List and keeps its policy until it is created again.
+	Retained bool `json:"retained,omitempty"`
+}
+
+// pluginState keeps track of the volumes created through the plugin and of the containers
+// using them. It is persisted to disk on every change so it survives a restart of the plugin.
+type pluginState struct {
+	path string
+	m    *sync.Mutex
+	// Mounts maps a Docker volume name to the mount count per container ID
+	Mounts map[string]map[string]int `json:"mounts"`
+	// Volumes maps a Docker volume name to its creation record
+	Volumes map[string]volumeRecord `json:"volumes"`
+}
+
+func newPluginState(path string) *pluginState {
+	return &pluginState{
+		path:    path,
+		m:       &sync.Mutex{},
+		Mounts:  make(map[string]map[string]int),
+		Volumes: make(map[string]volumeRecord),
+	}
+}
+
+// loadPluginState reads the state file at path. A missing file results in an empty state.
+func loadPluginState(path string) (*pluginState, error) {
+	state := newPluginState(path)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(content, state); err != nil {
+		return newPluginState(path), err
+	}
+	if state.Mounts == nil {
+		state.Mounts = make(map[string]map[string]int)
+	}
+	if state.Volumes == nil {
+		state.Volumes = make(map[string]volumeRecord)
+	}
+	return state, nil
+}
+
+// add registers a mount of volumeName by container id and returns the new number of active mounts
+func (state *pluginState) add(volumeName, id string) (int, error) {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	if _, ok := state.Mounts[volumeName]; !ok {
+		state.Mounts[volumeName] = make(map[string]int)
+	}
+	state.Mounts[volumeName][id]++
+	return state.countLocked(volumeName), state.saveLocked()
+}
+
+// remove unregisters a mount of volumeName by container id and returns the remaining number of active mounts
+func (state *pluginState) remove(volumeName, id string) (int, error) {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	containers, ok := state.Mounts[volumeName]
+	if !ok || containers[id] == 0 {
+		return state.countLocked(volumeName), nil
+	}
+	containers[id]--
+	if containers[id] == 0 {
+		delete(containers, id)
+	}
+	if len(containers) == 0 {
+		delete(state.Mounts, volumeName)
+	}
+	return state.countLocked(volumeName), state.saveLocked()
+}
+
+// setVolume stores the creation record of volumeName
+func (state *pluginState) setVolume(volumeName string, record volumeRecord) error {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	state.Volumes[volumeName] = record
+	return state.saveLocked()
+}
+
+// volume returns the creation record of volumeName
+func (state *pluginState) volume(volumeName string) (volumeRecord, bool) {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	record, ok := state.Volumes[volumeName]
+	return record, ok
+}
+
+// volumes returns a copy of all creation records
+func (state *pluginState) volumes() map[string]volumeRecord {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	records := make(map[string]volumeRecord, len(state.Volumes))
+	for name, record := range state.Volumes {
+		records[name] = record
+	}
+	return records
+}
+
+// forget drops everything recorded for volumeName
+func (state *pluginState) forget(volumeName string) error {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	_, mounted := state.Mounts[volumeName]
+	_, recorded := state.Volumes[volumeName]
+	if !mounted && !recorded {
+		return nil
+	}
+	delete(state.Mounts, volumeName)
+	delete(state.Volumes, volumeName)
+	return state.saveLocked()
+}
+
+// dropMounts unregisters all mounts of volumeName, but not of its subdirectories, and
+// returns the sorted ids of the containers which mounted it
+func (state *pluginState) dropMounts(volumeName string) ([]string, error) {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	containers, ok := state.Mounts[volumeName]
+	if !ok {
+		return nil, nil
+	}
+	var ids []string
+	for id := range containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	delete(state.Mounts, volumeName)
+	return ids, state.saveLocked()
+}
+
+// count returns the number of active mounts of volumeName
+func (state *pluginState) count(volumeName string) int {
+	state.m.Lock()
+	defer state.m.Unlock()
+	return state.countLocked(volumeName)
+}
+
+// containers returns the sorted IDs of the containers that use volumeName or one of its subdirectories
+func (state *pluginState) containers(volumeName string) []string {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	var ids []string
+	for name, containers := range state.Mounts {
+		if name != volumeName && !strings.HasPrefix(name, volumeName+"/") {
+			continue
+		}
+		for id := range containers {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// activeMounts returns the number of active mounts of all volumes
+func (state *pluginState) activeMounts() int {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	count := 0
+	for volumeName := range state.Mounts {
+		count += state.countLocked(volumeName)
+	}
+	return count
+}
+
+func (state *pluginState) countLocked(volumeName string) int {
+	count := 0
+	for _, mounts := range state.Mounts[volumeName] {
+		count += mounts
+	}
+	return count
+}
+
+func (state *pluginState) saveLocked() error {
+	if state.path == "" {
+		return nil
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated state file
+	tmpPath := state.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, state.path)
+}
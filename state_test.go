@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluginStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quobyte-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	state, _ := loadPluginState(statePath)
+	state.add("vol", "container-1")
+	state.add("vol/sub", "container-2")
+	state.add("other", "container-3")
+	state.remove("other", "container-3")
+	state.setVolume("vol", volumeRecord{CreatedByPlugin: true, TenantID: "tenant"})
+
+	loaded, err := loadPluginState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loaded.count("vol"); got != 1 {
+		log.Printf("Got:\n%d\nExpected:\n%d\n", got, 1)
+		t.FailNow()
+	}
+	if got := loaded.count("other"); got != 0 {
+		log.Printf("Got:\n%d\nExpected:\n%d\n", got, 0)
+		t.FailNow()
+	}
+	if got, ok := loaded.volume("vol"); !ok || !got.CreatedByPlugin || got.TenantID != "tenant" {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", got, volumeRecord{CreatedByPlugin: true, TenantID: "tenant"})
+		t.FailNow()
+	}
+	if got := loaded.containers("vol"); len(got) != 2 || got[0] != "container-1" || got[1] != "container-2" {
+		log.Printf("Got:\n%v\nExpected:\n%v\n", got, []string{"container-1", "container-2"})
+		t.FailNow()
+	}
+}
@@ -1,30 +1,79 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net/url"
-	"os/exec"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	quobyte_api "github.com/quobyte/api"
+)
+
+const (
+	initialBackoff time.Duration = 1 * time.Second
 )
 
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"ki":  1 << 10,
+	"kib": 1 << 10,
+	"kb":  1000,
+	"m":   1 << 20,
+	"mi":  1 << 20,
+	"mib": 1 << 20,
+	"mb":  1000 * 1000,
+	"g":   1 << 30,
+	"gi":  1 << 30,
+	"gib": 1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"t":   1 << 40,
+	"ti":  1 << 40,
+	"tib": 1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"p":   1 << 50,
+	"pi":  1 << 50,
+	"pib": 1 << 50,
+	"pb":  1000 * 1000 * 1000 * 1000 * 1000,
+}
+
 func validateAPIURL(apiURL string) error {
-	url, err := url.Parse(apiURL)
-	if err != nil {
-		return err
+	// SRV record names can be prefixed with the scheme of the discovered endpoints
+	srvName := apiURL
+	if idx := strings.Index(apiURL, "://"); idx >= 0 {
+		srvName = apiURL[idx+len("://"):]
 	}
-	if url.Scheme == "" {
-		return fmt.Errorf("Scheme is no set in URL: %s", apiURL)
+	if quobyte_api.IsSRVName(srvName) {
+		return nil
+	}
+	_, err := quobyte_api.ParseEndpoints(apiURL)
+	return err
+}
+
+// resolveRegistry turns a registry SRV record name into the list of registry
+// endpoints for the mount command. Other registry values are returned as they are.
+func resolveRegistry(registry string) (string, error) {
+	if !quobyte_api.IsSRVName(registry) {
+		return registry, nil
 	}
 
-	return nil
+	endpoints, err := quobyte_api.LookupSRVEndpoints(registry)
+	if err != nil {
+		return "", err
+	}
+	logrus.Debugf("Resolved registry %s to %s", registry, strings.Join(endpoints, ","))
+	return strings.Join(endpoints, ","), nil
 }
 
 func isMounted(mountPath string) bool {
 	content, err := ioutil.ReadFile("/proc/mounts")
 	if err != nil {
-		log.Println(err)
+		logrus.Errorf("Unable to read mounts: %s", err)
 	}
 	for _, mount := range strings.Split(string(content), "\n") {
 		splitted := strings.Split(mount, " ")
@@ -37,7 +86,6 @@ func isMounted(mountPath string) bool {
 		}
 
 		if splitted[1] == mountPath {
-			log.Printf("Found Mountpoint: %s\n", mountPath)
 			return true
 		}
 	}
@@ -45,10 +93,42 @@ func isMounted(mountPath string) bool {
 	return false
 }
 
-func mountAll(mountQuobyteOptions, quobyteRegistry, mountQuobytePath string) {
-	cmdStr := fmt.Sprintf("mount %s -t quobyte %s %s", mountQuobyteOptions, fmt.Sprintf("%s/", quobyteRegistry), mountQuobytePath)
-	if out, err := exec.Command("/bin/sh", "-c", cmdStr).CombinedOutput(); err != nil {
-		log.Println(err)
-		log.Fatalln(string(out))
+// backoffDelay returns the exponential wait time before the given (1-based) retry attempt
+func backoffDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	return initialBackoff << uint(attempt-1)
+}
+
+// parseSize converts a human readable size like 10GiB, 500MB or 1t into bytes. Units
+// with an i or without a B are binary (1024 based), units with a B are decimal.
+func parseSize(size string) (uint64, error) {
+	trimmed := strings.TrimSpace(size)
+	split := strings.IndexFunc(trimmed, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split < 0 {
+		split = len(trimmed)
+	}
+
+	value, err := strconv.ParseFloat(trimmed[:split], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(trimmed[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("Invalid size unit in %q, use e.g. 512MiB, 10GiB or 1TB", size)
+	}
+
+	return uint64(value * float64(unit)), nil
+}
+
+// newRequestID returns a random ID which correlates the log lines and API calls of one request
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
+	return hex.EncodeToString(id)
 }
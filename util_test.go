@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"log"
 	"testing"
+	"time"
 )
 
 func TestValidateAPIURL(t *testing.T) {
 	expectedResults := map[string]error{
-		"localhost:7860":        fmt.Errorf("Scheme is no set in URL: localhost:7860"),
-		"http://localhost:7860": nil,
+		"localhost:7860":                          fmt.Errorf("Scheme is no set in URL: localhost:7860"),
+		"http://localhost:7860":                   nil,
+		"https://api1:7860,api2:7860,http://api3": nil,
+		"ftp://localhost:7860":                    fmt.Errorf("Unsupported scheme ftp in URL: ftp://localhost:7860"),
+		"_quobyte-api._tcp.example.com":           nil,
+		"https://_quobyte-api._tcp.example.com":   nil,
 	}
 
 	for url, res := range expectedResults {
@@ -20,3 +25,55 @@ func TestValidateAPIURL(t *testing.T) {
 		}
 	}
 }
+
+func TestBackoffDelay(t *testing.T) {
+	expectedResults := map[int]time.Duration{
+		0: 1 * time.Second,
+		1: 1 * time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		5: 16 * time.Second,
+	}
+
+	for attempt, res := range expectedResults {
+		if got := backoffDelay(attempt); got != res {
+			log.Printf("Got:\n%v\nExpected:\n%v\nAttempt:\n%d\n", got, res, attempt)
+			t.FailNow()
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	expectedResults := map[string]uint64{
+		"1024":    1024,
+		"10GiB":   10 << 30,
+		"10g":     10 << 30,
+		"1.5 Ki":  1536,
+		"500MB":   500 * 1000 * 1000,
+		"2TiB":    2 << 40,
+		" 1 kib ": 1024,
+	}
+
+	for size, res := range expectedResults {
+		got, err := parseSize(size)
+		if err != nil || got != res {
+			log.Printf("Got:\n%v (%v)\nExpected:\n%v\nSize:\n%s\n", got, err, res, size)
+			t.FailNow()
+		}
+	}
+
+	for _, size := range []string{"", "GiB", "10XB", "-1G", "1.2.3G"} {
+		if _, err := parseSize(size); err == nil {
+			log.Printf("Expected error for size %q\n", size)
+			t.FailNow()
+		}
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	first, second := newRequestID(), newRequestID()
+	if len(first) != 16 || first == second {
+		log.Printf("Got:\n%s and %s\nExpected:\ntwo different IDs of 16 hex digits\n", first, second)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+
+	quobyte_api "github.com/quobyte/api"
+)
+
+// recordLabel is the label of a Quobyte volume which holds the volumeRecord of the Docker
+// volume. The state file is local to the host, the label makes the settings of the volume
+// like its deletion policy apply on every host and after a reboot.
+const recordLabel = "docker-volume"
+
+// recordLabelName returns the label holding the record of a Docker volume. Subdirectory
+// volumes keep their record on the Quobyte volume they live in.
+func recordLabelName(subDirs string) string {
+	if subDirs == "" {
+		return recordLabel
+	}
+	return recordLabel + ":" + subDirs
+}
+
+// labelRecord returns the record of the Docker volume with subdirectory subDirs stored in the
+// labels of its Quobyte volume
+func labelRecord(labels []quobyte_api.Label, subDirs string) (volumeRecord, bool) {
+	name := recordLabelName(subDirs)
+	for _, label := range labels {
+		if label.Name != name {
+			continue
+		}
+		var record volumeRecord
+		if err := json.Unmarshal([]byte(label.Value), &record); err != nil {
+			return volumeRecord{}, false
+		}
+		return record, true
+	}
+	return volumeRecord{}, false
+}
+
+// recordOf returns the record of the Docker volume name from the labels of its Quobyte volume
+// vol and keeps a copy in the state file. Volumes without label, e.g. created by an older
+// version of the plugin, fall back to the record of the state file.
+func (driver quobyteDriver) recordOf(name string, vol quobyte_api.Volume) (volumeRecord, bool) {
+	_, subDirs, _ := driver.stripVolumeName(name)
+	record, ok := labelRecord(vol.Labels, subDirs)
+	if !ok {
+		return driver.state.volume(name)
+	}
+	if cached, _ := driver.state.volume(name); cached != record {
+		if err := driver.state.setVolume(name, record); err != nil {
+			driver.log.Errorf("Unable to persist volume state: %s", err)
+		}
+	}
+	return record, true
+}
+
+// storeRecord saves the record of the Docker volume name in the label of its Quobyte volume
+// with the given UUID and in the state file
+func (driver quobyteDriver) storeRecord(name, volumeUUID string, record volumeRecord) error {
+	if err := driver.state.setVolume(name, record); err != nil {
+		driver.log.Errorf("Unable to persist volume state: %s", err)
+	}
+	_, subDirs, _ := driver.stripVolumeName(name)
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return driver.client.SetVolumeLabel(volumeUUID, recordLabelName(subDirs), string(value))
+}
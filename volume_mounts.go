@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// mountModeShared uses a single multi-volume mount of the Quobyte namespace
+	mountModeShared string = "shared"
+	// mountModePerVolume mounts every Quobyte volume on its own while containers use it
+	mountModePerVolume string = "per-volume"
+)
+
+func validateMountMode(mode string) error {
+	switch mode {
+	case mountModeShared, mountModePerVolume:
+		return nil
+	}
+	return fmt.Errorf("Unknown mount mode %q, valid modes are %s and %s", mode, mountModeShared, mountModePerVolume)
+}
+
+// perVolumeMounter mounts Quobyte volumes on their own, it is implemented by volumeMounter
+type perVolumeMounter interface {
+	path(volumeName string) string
+	mount(volumeName, options string) error
+	unmount(volumeName string) error
+}
+
+// volumeMounter mounts Quobyte volumes individually below a plugin managed directory
+type volumeMounter struct {
+	base   string
+	config mountConfig
+}
+
+func (mounter *volumeMounter) path(volumeName string) string {
+	return filepath.Join(mounter.base, volumeName)
+}
+
+// mount mounts the volume with the global FUSE options followed by the volumes own options.
+// An existing mount of the volume is reused.
+func (mounter *volumeMounter) mount(volumeName, options string) error {
+	target := mounter.path(volumeName)
+	if isMounted(target) {
+		return nil
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	config := mounter.config
+	config.options = strings.TrimSpace(config.options + " " + options)
+	logrus.WithField("volume", volumeName).Infof("Mounting Quobyte volume %s on %s", volumeName, target)
+	return mountVolume(config, volumeName, target)
+}
+
+// unmount tears down the mount of the volume, lazily if it is still busy
+func (mounter *volumeMounter) unmount(volumeName string) error {
+	target := mounter.path(volumeName)
+	if !isMounted(target) {
+		return nil
+	}
+
+	logrus.WithField("volume", volumeName).Infof("Unmounting Quobyte volume %s from %s", volumeName, target)
+	if err := unmount(target, false); err != nil {
+		logrus.WithField("volume", volumeName).Warnf("%s, retrying with a lazy unmount", err)
+		if err := unmount(target, true); err != nil {
+			return err
+		}
+	}
+	return os.Remove(target)
+}
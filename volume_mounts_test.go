@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// fakeMounter records which volumes are mounted instead of mounting them
+type fakeMounter struct {
+	base     string
+	mounted  map[string]bool
+	unmounts []string
+}
+
+func (mounter *fakeMounter) path(volumeName string) string {
+	return filepath.Join(mounter.base, volumeName)
+}
+
+func (mounter *fakeMounter) mount(volumeName, options string) error {
+	mounter.mounted[volumeName] = true
+	return nil
+}
+
+func (mounter *fakeMounter) unmount(volumeName string) error {
+	if !mounter.mounted[volumeName] {
+		return nil
+	}
+	delete(mounter.mounted, volumeName)
+	mounter.unmounts = append(mounter.unmounts, volumeName)
+	return nil
+}
+
+func TestVolumeMounterPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quobyte-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounter := &volumeMounter{base: dir}
+	if got := mounter.path("vol"); got != filepath.Join(dir, "vol") {
+		log.Printf("Got:\n%s\nExpected:\n%s\n", got, filepath.Join(dir, "vol"))
+		t.FailNow()
+	}
+
+	// A volume which is not mounted is left alone
+	if err := os.Mkdir(mounter.path("vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mounter.unmount("vol"); err != nil {
+		log.Printf("Got:\n%v\nExpected:\nno error\n", err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(mounter.path("vol")); err != nil {
+		log.Printf("Got:\n%v\nExpected:\n%s to be kept\n", err, mounter.path("vol"))
+		t.FailNow()
+	}
+}
+
+func TestVolumeMountRelease(t *testing.T) {
+	driver, cleanup := newTestDriver(t, newFakeAPI(nil))
+	defer cleanup()
+	mounter := &fakeMounter{base: driver.quobyteMount, mounted: make(map[string]bool)}
+	driver.mounter = mounter
+
+	for _, request := range []volume.MountRequest{
+		{Name: "vol", ID: "container-1"},
+		{Name: "vol/sub", ID: "container-2"},
+		{Name: "other", ID: "container-3"},
+	} {
+		if response := driver.Mount(request); response.Err != "" || response.Mountpoint != driver.mountPoint(request.Name) {
+			log.Printf("Got:\n%v\nExpected:\n%s\n", response, driver.mountPoint(request.Name))
+			t.FailNow()
+		}
+	}
+
+	// The volume is released once neither the volume nor one of its subdirectories is in use
+	expectedResults := []struct {
+		request  volume.UnmountRequest
+		unmounts []string
+	}{
+		{volume.UnmountRequest{Name: "vol", ID: "container-1"}, nil},
+		{volume.UnmountRequest{Name: "vol/sub", ID: "container-2"}, []string{"vol"}},
+		{volume.UnmountRequest{Name: "other", ID: "container-3"}, []string{"vol", "other"}},
+	}
+	for _, res := range expectedResults {
+		driver.Unmount(res.request)
+		if !reflect.DeepEqual(mounter.unmounts, res.unmounts) {
+			log.Printf("Got:\n%v\nExpected:\n%v\n", mounter.unmounts, res.unmounts)
+			t.FailNow()
+		}
+	}
+	if len(mounter.mounted) != 0 {
+		log.Printf("Got:\n%v\nExpected:\nno mounted volumes\n", mounter.mounted)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// mountWatchdog periodically checks the Quobyte namespace mount and remounts it
+// if the FUSE client died or the mount went stale.
+type mountWatchdog struct {
+	path         string
+	config       mountConfig
+	interval     time.Duration
+	probeTimeout time.Duration
+
+	// check and repair default to checkMount and remount
+	check  func() error
+	repair func() error
+
+	m         *sync.Mutex
+	lastError error
+}
+
+func newMountWatchdog(path string, config mountConfig, interval time.Duration) *mountWatchdog {
+	watchdog := &mountWatchdog{
+		path:         path,
+		config:       config,
+		interval:     interval,
+		probeTimeout: 10 * time.Second,
+		m:            &sync.Mutex{},
+	}
+	watchdog.check = watchdog.checkMount
+	watchdog.repair = watchdog.remount
+	return watchdog
+}
+
+// err returns why the namespace is unhealthy, or nil if it is healthy
+func (watchdog *mountWatchdog) err() error {
+	if watchdog == nil {
+		return nil
+	}
+	watchdog.m.Lock()
+	defer watchdog.m.Unlock()
+	return watchdog.lastError
+}
+
+func (watchdog *mountWatchdog) setError(err error) {
+	watchdog.m.Lock()
+	defer watchdog.m.Unlock()
+	watchdog.lastError = err
+}
+
+// run checks the mount every interval until stop is closed
+func (watchdog *mountWatchdog) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(watchdog.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			watchdog.checkAndRepair()
+		}
+	}
+}
+
+func (watchdog *mountWatchdog) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"op": "watchdog", "path": watchdog.path})
+}
+
+func (watchdog *mountWatchdog) checkAndRepair() {
+	err := watchdog.check()
+	if err == nil {
+		if watchdog.err() != nil {
+			watchdog.log().Infof("Quobyte namespace at %s is healthy again", watchdog.path)
+		}
+		watchdog.setError(nil)
+		return
+	}
+
+	watchdog.log().Errorf("Quobyte namespace at %s is unhealthy, remounting: %s", watchdog.path, err)
+	watchdog.setError(err)
+	if repairErr := watchdog.repair(); repairErr != nil {
+		watchdog.log().Errorf("Unable to remount Quobyte namespace at %s: %s", watchdog.path, repairErr)
+		watchdog.setError(fmt.Errorf("%s, remount failed: %s", err, repairErr))
+		return
+	}
+
+	if err := watchdog.check(); err != nil {
+		watchdog.setError(err)
+		return
+	}
+	watchdog.log().Infof("Remounted Quobyte namespace at %s", watchdog.path)
+	watchdog.setError(nil)
+}
+
+// checkMount verifies the path is a quobyte mount in /proc/mounts and answers a stat in time
+func (watchdog *mountWatchdog) checkMount() error {
+	if !isMounted(watchdog.path) {
+		return fmt.Errorf("%s is not mounted", watchdog.path)
+	}
+	return probeStat(watchdog.path, watchdog.probeTimeout)
+}
+
+// remount lazily unmounts the stale mount, so processes still holding it do not block, and mounts it again
+func (watchdog *mountWatchdog) remount() error {
+	if isMounted(watchdog.path) {
+		if err := unmount(watchdog.path, true); err != nil {
+			watchdog.log().Warn(err)
+		}
+	}
+	if err := os.MkdirAll(watchdog.path, 0555); err != nil {
+		watchdog.log().Warn(err)
+	}
+	return mountAll(watchdog.config, watchdog.path)
+}
+
+// stat is os.Stat, tests replace it to simulate a hanging mount
+var stat = os.Stat
+
+// statCall is a stat of probeStat, err is set once done is closed
+type statCall struct {
+	done chan struct{}
+	err  error
+}
+
+// pendingStats holds the stat calls which did not return yet. A stat on a dead FUSE mount
+// can hang for good, so each path gets at most one outstanding call whose result is shared
+// by all probes until it returns instead of leaking a goroutine per probe.
+var pendingStats = struct {
+	sync.Mutex
+	calls map[string]*statCall
+}{calls: make(map[string]*statCall)}
+
+// probeStat stats path and fails if it errors, e.g. with ENOTCONN on a dead FUSE mount, or hangs
+func probeStat(path string, timeout time.Duration) error {
+	pendingStats.Lock()
+	call, ok := pendingStats.calls[path]
+	if !ok {
+		call = &statCall{done: make(chan struct{})}
+		pendingStats.calls[path] = call
+		go func() {
+			_, err := stat(path)
+			pendingStats.Lock()
+			delete(pendingStats.calls, path)
+			pendingStats.Unlock()
+			call.err = err
+			close(call.done)
+		}()
+	}
+	pendingStats.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-time.After(timeout):
+		return fmt.Errorf("stat of %s did not return within %v", path, timeout)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeStat(t *testing.T) {
+	if err := probeStat(os.TempDir(), time.Second); err != nil {
+		log.Printf("Got:\n%v\nExpected:\nno error\n", err)
+		t.FailNow()
+	}
+
+	// A dead FUSE mount answers stat with an error or not at all
+	var calls int32
+	hang := make(chan struct{})
+	stat = func(path string) (os.FileInfo, error) {
+		atomic.AddInt32(&calls, 1)
+		<-hang
+		return nil, nil
+	}
+	defer func() { stat = os.Stat }()
+
+	// Repeated timeouts wait for the same hanging stat instead of starting new ones
+	expected := fmt.Errorf("stat of /mnt/quobyte did not return within %v", 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := probeStat("/mnt/quobyte", 10*time.Millisecond); fmt.Sprint(err) != fmt.Sprint(expected) {
+			log.Printf("Got:\n%v\nExpected:\n%v\n", err, expected)
+			t.FailNow()
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		log.Printf("Got:\n%d stat calls\nExpected:\n%d\n", got, 1)
+		t.FailNow()
+	}
+
+	// Once the stat returns its result is used and the next probe stats again
+	close(hang)
+	if err := probeStat("/mnt/quobyte", time.Second); err != nil {
+		log.Printf("Got:\n%v\nExpected:\nno error\n", err)
+		t.FailNow()
+	}
+	if err := probeStat("/mnt/quobyte", time.Second); err != nil {
+		log.Printf("Got:\n%v\nExpected:\nno error\n", err)
+		t.FailNow()
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		log.Printf("Got:\n%d stat calls\nExpected:\n%d\n", got, 2)
+		t.FailNow()
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	var checkResults []error
+	repairs := 0
+	watchdog := newMountWatchdog("/mnt/quobyte", mountConfig{}, time.Minute)
+	watchdog.check = func() error {
+		err := checkResults[0]
+		checkResults = checkResults[1:]
+		return err
+	}
+
+	stale := errors.New("transport endpoint is not connected")
+	expectedResults := []struct {
+		checks  []error
+		repair  error
+		err     string
+		repairs int
+	}{
+		// healthy mounts are left alone
+		{[]error{nil}, nil, "<nil>", 0},
+		// a successful remount makes the namespace healthy again
+		{[]error{stale, nil}, nil, "<nil>", 1},
+		// the mount is still broken after the remount
+		{[]error{stale, stale}, nil, stale.Error(), 2},
+		// the remount fails
+		{[]error{stale}, errors.New("mount failed"), stale.Error() + ", remount failed: mount failed", 3},
+		// the namespace recovers on its own
+		{[]error{nil}, nil, "<nil>", 3},
+	}
+
+	for _, res := range expectedResults {
+		checkResults = res.checks
+		repairErr := res.repair
+		watchdog.repair = func() error {
+			repairs++
+			return repairErr
+		}
+		watchdog.checkAndRepair()
+		if got := fmt.Sprint(watchdog.err()); got != res.err || repairs != res.repairs || len(checkResults) != 0 {
+			log.Printf("Got:\n%s %d\nExpected:\n%s %d\n", got, repairs, res.err, res.repairs)
+			t.FailNow()
+		}
+	}
+}